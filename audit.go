@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+const auditActionCreate string = "create"
+const auditActionUpdate string = "update"
+const auditActionDelete string = "delete"
+const auditActionRestore string = "restore"
+
+// anonymousActor is recorded for requests that do not name their actor.
+const anonymousActor string = "anonymous"
+
+// locationAudit records one change of a location. Version is the version the change
+// produced, or for a delete the version that was deleted.
+type locationAudit struct {
+	ID         bson.ObjectId   `json:"id" bson:"_id"`
+	LocationID bson.ObjectId   `json:"location_id" bson:"location_id"`
+	Action     string          `json:"action" bson:"action"`
+	Version    int             `json:"version" bson:"version"`
+	Actor      string          `json:"actor" bson:"actor"`
+	Timestamp  time.Time       `json:"timestamp" bson:"timestamp"`
+	Before     *locationStruct `json:"before,omitempty" bson:"before,omitempty"`
+	After      *locationStruct `json:"after,omitempty" bson:"after,omitempty"`
+	Changes    []fieldChange   `json:"changes" bson:"changes"`
+	//Geocoder is the geocoder asked for the coordinate or address during the change, if any
+	Geocoder string `json:"geocoder,omitempty" bson:"geocoder,omitempty"`
+}
+
+// fieldChange is a field that differs between two versions of a location. Nested
+// fields are named by their path, like coordinate.lat.
+type fieldChange struct {
+	Field string      `json:"field" bson:"field"`
+	From  interface{} `json:"from,omitempty" bson:"from,omitempty"`
+	To    interface{} `json:"to,omitempty" bson:"to,omitempty"`
+}
+
+type locationHistory struct {
+	LocationID string          `json:"location_id"`
+	History    []locationAudit `json:"history"`
+}
+
+// requestActor names who made a request, taken from the X-Actor header.
+func requestActor(r *http.Request) string {
+	if actor := r.Header.Get("X-Actor"); len(actor) > 0 {
+		return actor
+	}
+	return anonymousActor
+}
+
+// recordLocationChange appends a change to the history of a location. before is nil
+// for creations and after for deletions. The change is already saved, so a failure
+// to record it is only logged.
+func recordLocationChange(actor string, action string, before *locationStruct, after *locationStruct, geocoded bool) {
+	record := locationAudit{
+		ID:        bson.NewObjectId(),
+		Action:    action,
+		Actor:     actor,
+		Timestamp: time.Now().UTC(),
+		Before:    before,
+		After:     after,
+		Changes:   diffLocations(before, after),
+	}
+	if after != nil {
+		record.LocationID, record.Version = after.ID, after.Version
+	} else {
+		record.LocationID, record.Version = before.ID, before.Version
+	}
+	if geocoded {
+		record.Geocoder = locationGeocoder.Name()
+	}
+	err := store.InsertAudit(record)
+	if err != nil {
+		fmt.Println("Unable to record the change of location ", record.LocationID.Hex(), " : ", err)
+	}
+}
+
+// diffLocations lists the fields that differ between two versions of a location,
+// either of which may be nil. The version itself is left out.
+func diffLocations(before *locationStruct, after *locationStruct) []fieldChange {
+	from, to := flattenLocation(before), flattenLocation(after)
+	fields := make([]string, 0, len(from)+len(to))
+	for field := range from {
+		fields = append(fields, field)
+	}
+	for field := range to {
+		if _, ok := from[field]; !ok {
+			fields = append(fields, field)
+		}
+	}
+	sort.Strings(fields)
+
+	changes := make([]fieldChange, 0)
+	for _, field := range fields {
+		if field != "version" && !reflect.DeepEqual(from[field], to[field]) {
+			changes = append(changes, fieldChange{Field: field, From: from[field], To: to[field]})
+		}
+	}
+	return changes
+}
+
+// flattenLocation maps the path of every JSON field of location to its value.
+func flattenLocation(location *locationStruct) map[string]interface{} {
+	fields := make(map[string]interface{})
+	if location == nil {
+		return fields
+	}
+	var value interface{}
+	data, err := json.Marshal(location)
+	if err == nil {
+		err = json.Unmarshal(data, &value)
+	}
+	if err != nil {
+		return fields
+	}
+	var flatten func(prefix string, value interface{})
+	flatten = func(prefix string, value interface{}) {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			fields[prefix] = value
+			return
+		}
+		for key, nested := range object {
+			if len(prefix) > 0 {
+				key = prefix + "." + key
+			}
+			flatten(key, nested)
+		}
+	}
+	flatten("", value)
+	return fields
+}
+
+// getLocationHistory serves GET /locations/:locationID/history, oldest change first.
+func getLocationHistory(w http.ResponseWriter, r *http.Request) {
+	locationID := r.URL.Query().Get(":locationID")
+	history, err := store.LocationHistory(locationID)
+	if err == nil && len(history) == 0 {
+		//Tell unknown locations apart from ones saved before changes were recorded
+		_, err = store.FindLocation(locationID)
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, locationHistory{LocationID: locationID, History: history})
+}
+
+// restoreLocation serves POST /locations/:locationID/restore?version=N, saving the
+// location as it was at version N as its next version. A deleted location is
+// recreated under its old ID.
+func restoreLocation(w http.ResponseWriter, r *http.Request) {
+	locationID := r.URL.Query().Get(":locationID")
+	version, err := strconv.Atoi(r.URL.Query().Get("version"))
+	if err != nil || version < 1 {
+		writeError(w, badRequest("invalid_version", "version must be a positive integer", map[string]string{"version": r.URL.Query().Get("version")}))
+		return
+	}
+	history, err := store.LocationHistory(locationID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	var restored locationStruct
+	found, latest := false, 0
+	for _, record := range history {
+		if record.After != nil && record.After.Version == version {
+			restored, found = *record.After, true
+		}
+		if record.Version > latest {
+			latest = record.Version
+		}
+	}
+	if !found {
+		writeError(w, notFound("version_not_found", "The history of the location has no such version", map[string]int{"version": version}))
+		return
+	}
+
+	var before *locationStruct
+	saved, err := store.FindLocation(locationID)
+	if err == nil {
+		before = &saved
+		err = checkIfMatch(r, saved.Version)
+		if err == nil {
+			restored.Version = saved.Version + 1
+			err = store.UpdateLocation(restored, saved.Version)
+		}
+	} else if err == errNotFound {
+		restored.Version = latest + 1
+		err = store.InsertLocation(restored)
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	recordLocationChange(requestActor(r), auditActionRestore, before, &restored, false)
+	writeVersionedJSON(w, http.StatusOK, restored.Version, restored)
+}
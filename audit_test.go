@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestDiffLocations(t *testing.T) {
+	before := testLocation("Office", 1)
+	before.Tags = []string{"work"}
+	after := before
+	after.Version = 2
+	after.Name = "Head office"
+	after.Coordinate.Lat += 0.01
+	after.Notes = "Ring twice"
+
+	changes := diffLocations(&before, &after)
+	fields := make([]string, 0, len(changes))
+	for _, change := range changes {
+		fields = append(fields, change.Field)
+	}
+	//Sorted by field, without the version
+	want := []string{"coordinate.lat", "name", "notes"}
+	if len(fields) != len(want) || fields[0] != want[0] || fields[1] != want[1] || fields[2] != want[2] {
+		t.Fatalf("got changes %+v, want fields %v", changes, want)
+	}
+	if changes[1].From != "Office" || changes[1].To != "Head office" || changes[2].From != nil {
+		t.Errorf("got changes %+v", changes)
+	}
+
+	if created := diffLocations(nil, &before); len(created) == 0 {
+		t.Error("a creation changes no field")
+	}
+	for _, change := range diffLocations(&before, nil) {
+		if change.To != nil {
+			t.Errorf("a deletion changes %s to %v", change.Field, change.To)
+		}
+	}
+	if same := diffLocations(&before, &before); len(same) != 0 {
+		t.Errorf("a location differs from itself in %+v", same)
+	}
+}
+
+func TestLocationHistoryAndRestore(t *testing.T) {
+	server, stop := newTestServer(t)
+	defer stop()
+	id := addTestLocation(t, server, "Office", "94105")
+	path := "/locations/" + id
+
+	updated := map[string]interface{}{"name": "Head office", "address": "1 Main St", "zip": "94105", "notes": "Ring twice"}
+	if status, _ := sendJSONWithHeader(t, server, "PUT", path, http.Header{"If-Match": {versionETag(1)}, "X-Actor": {"dispatch"}}, updated, nil); status != http.StatusOK {
+		t.Fatalf("the update got %d", status)
+	}
+
+	var history locationHistory
+	if status := sendJSON(t, server, "GET", path+"/history", nil, &history); status != http.StatusOK || len(history.History) != 2 {
+		t.Fatalf("got %d %+v", status, history)
+	}
+	created, update := history.History[0], history.History[1]
+	if created.Action != auditActionCreate || created.Version != 1 || created.Actor != anonymousActor || created.Before != nil || created.Geocoder != "gazetteer" {
+		t.Errorf("got creation %+v", created)
+	}
+	if update.Action != auditActionUpdate || update.Version != 2 || update.Actor != "dispatch" || update.Before.Name != "Office" || update.After.Name != "Head office" {
+		t.Errorf("got update %+v", update)
+	}
+
+	//Restoring a location that still exists needs its ETag
+	var failed apiError
+	if status := sendJSON(t, server, "POST", path+"/restore?version=1", nil, &failed); status != http.StatusPreconditionRequired {
+		t.Errorf("a restore without If-Match got %d %q", status, failed.Code)
+	}
+	if status, _ := sendJSONWithHeader(t, server, "POST", path+"/restore?version=1", http.Header{"If-Match": {versionETag(1)}}, nil, &failed); status != http.StatusPreconditionFailed {
+		t.Errorf("a restore with a stale ETag got %d %q", status, failed.Code)
+	}
+	var restored locationStruct
+	status, header := sendJSONWithHeader(t, server, "POST", path+"/restore?version=1", http.Header{"If-Match": {versionETag(2)}}, nil, &restored)
+	if status != http.StatusOK || restored.Name != "Office" || restored.Notes != "" || restored.Version != 3 || header.Get("ETag") != versionETag(3) {
+		t.Errorf("the restore got %d %+v with ETag %s", status, restored, header.Get("ETag"))
+	}
+
+	//A deleted location comes back under its ID, after the last version it had
+	if status, _ := sendJSONWithHeader(t, server, "DELETE", path, nil, nil, nil); status != http.StatusPreconditionRequired {
+		t.Fatalf("a delete without If-Match got %d", status)
+	}
+	if status, _ := sendJSONWithHeader(t, server, "DELETE", path, http.Header{"If-Match": {versionETag(3)}}, nil, nil); status != http.StatusOK {
+		t.Fatalf("the delete got %d", status)
+	}
+	restored = locationStruct{}
+	if status := sendJSON(t, server, "POST", path+"/restore?version=2", nil, &restored); status != http.StatusOK || restored.ID.Hex() != id || restored.Name != "Head office" || restored.Version != 4 {
+		t.Errorf("restoring the deleted location got %d %+v", status, restored)
+	}
+
+	history = locationHistory{}
+	sendJSON(t, server, "GET", path+"/history", nil, &history)
+	actions := ""
+	for _, record := range history.History {
+		actions += record.Action + " "
+	}
+	if actions != "create update restore delete restore " {
+		t.Errorf("the history is %q", actions)
+	}
+
+	tests := []struct {
+		method     string
+		path       string
+		wantStatus int
+		wantCode   string
+	}{
+		{"POST", path + "/restore?version=0", http.StatusBadRequest, "invalid_version"},
+		{"POST", path + "/restore?version=latest", http.StatusBadRequest, "invalid_version"},
+		{"POST", path + "/restore?version=9", http.StatusNotFound, "version_not_found"},
+		{"GET", "/locations/5717c9e8a2c3c1b8e4a3d4f1/history", http.StatusNotFound, "not_found"},
+		{"GET", "/locations/office/history", http.StatusBadRequest, "invalid_id"},
+	}
+	for _, test := range tests {
+		var failed apiError
+		if status := sendJSON(t, server, test.method, test.path, nil, &failed); status != test.wantStatus || failed.Code != test.wantCode {
+			t.Errorf("%s %s: got %d %q, want %d %s", test.method, test.path, status, failed.Code, test.wantStatus, test.wantCode)
+		}
+	}
+}
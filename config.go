@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// serverConfig holds the tunables of the trip planner. Values are read from
+// the environment once at startup so the defaults below can be overridden
+// without a rebuild.
+type serverConfig struct {
+	ListenAddr string
+	//Trips with more stops than this are planned heuristically instead of exactly,
+	//at most maxExactStopsLimit
+	MaxExactStops int
+	//Time the 2-opt/Or-opt pass may spend improving a heuristic route
+	LocalSearchBudget time.Duration
+	//Where price estimates come from, "uber" or "offline". The uber provider needs
+	//the server token, ride requests need the sandbox bearer token.
+	PriceProvider    string
+	UberServerToken  string
+	UberSandboxToken string
+	OfflineRates     offlineRates
+	//Where locations and trips are kept, "mongo", "memory" or "file". The mongo store
+	//needs MongoURL, an empty MongoDBName uses the database named in the URL.
+	StoreProvider string
+	MongoURL      string
+	MongoDBName   string
+	StoreFile     string
+	//Which geocoder resolves addresses, "google", "nominatim" or "gazetteer"
+	GeocoderProvider   string
+	GoogleAPIKey       string
+	NominatimURL       string
+	NominatimUserAgent string
+	//CSV of zip,city,state,lat,lng centroids used by the gazetteer geocoder
+	GazetteerCSV string
+	//How long geocoding answers are reused from the store, 0 disables the cache
+	GeocodeCacheTTL time.Duration
+	//Uber product ID or display name to price trips with, the first product offered when empty
+	UberProduct string
+	//Number of price estimates fetched in parallel and how long they are reused
+	PriceFetchConcurrency int
+	PriceCacheTTL         time.Duration
+	//What deleting a location used by a trip does, "block" refuses while the trip is
+	//not completed and "tombstone" keeps a record of the deleted location
+	LocationDeletePolicy string
+}
+
+var config = loadConfig()
+
+// maxExactStopsLimit bounds MaxExactStops. The exact solver keeps three tables with
+// an entry for every subset of stops and last stop, about 25MB at 16 stops, and
+// each stop more doubles them.
+const maxExactStopsLimit int = 16
+
+func loadConfig() serverConfig {
+	return serverConfig{
+		ListenAddr:         envString("TRIP_LISTEN_ADDR", ":8088"),
+		MaxExactStops:      envInt("TRIP_MAX_EXACT_STOPS", 12),
+		LocalSearchBudget:  time.Duration(envInt("TRIP_LOCAL_SEARCH_MS", 2000)) * time.Millisecond,
+		UberProduct:        envString("TRIP_UBER_PRODUCT", ""),
+		PriceProvider:      envString("TRIP_PRICE_PROVIDER", "uber"),
+		UberServerToken:    envString("TRIP_UBER_SERVER_TOKEN", ""),
+		UberSandboxToken:   envString("TRIP_UBER_SANDBOX_TOKEN", ""),
+		StoreProvider:      envString("TRIP_STORE", "mongo"),
+		MongoURL:           envString("TRIP_MONGO_URL", ""),
+		MongoDBName:        envString("TRIP_MONGO_DB", ""),
+		StoreFile:          envString("TRIP_STORE_FILE", "trip_planner.json"),
+		GeocoderProvider:   envString("TRIP_GEOCODER", "google"),
+		GoogleAPIKey:       envString("TRIP_GOOGLE_API_KEY", ""),
+		NominatimURL:       envString("TRIP_NOMINATIM_URL", "https://nominatim.openstreetmap.org"),
+		NominatimUserAgent: envString("TRIP_NOMINATIM_USER_AGENT", "Uber_Trip_Requester"),
+		GazetteerCSV:       envString("TRIP_GAZETTEER_CSV", "gazetteer.csv"),
+		OfflineRates: offlineRates{
+			BaseFare:    envFloat("TRIP_OFFLINE_BASE_FARE", 2.0),
+			PerMile:     envFloat("TRIP_OFFLINE_PER_MILE", 1.5),
+			PerMinute:   envFloat("TRIP_OFFLINE_PER_MINUTE", 0.25),
+			MinimumFare: envFloat("TRIP_OFFLINE_MINIMUM_FARE", 5.0),
+			SpeedMph:    envFloat("TRIP_OFFLINE_SPEED_MPH", 25),
+		},
+
+		PriceFetchConcurrency: envInt("TRIP_PRICE_CONCURRENCY", 8),
+		PriceCacheTTL:         time.Duration(envInt("TRIP_PRICE_CACHE_TTL_SECONDS", 300)) * time.Second,
+		LocationDeletePolicy:  envString("TRIP_LOCATION_DELETE", deletePolicyBlock),
+		GeocodeCacheTTL:       time.Duration(envInt("TRIP_GEOCODE_CACHE_TTL_HOURS", 30*24)) * time.Hour,
+	}
+}
+
+// validate reports the settings that would make the server misbehave, checked at startup.
+func (cfg serverConfig) validate() error {
+	if cfg.MaxExactStops < 0 || cfg.MaxExactStops > maxExactStopsLimit {
+		return fmt.Errorf("TRIP_MAX_EXACT_STOPS must be between 0 and %d, got %d", maxExactStopsLimit, cfg.MaxExactStops)
+	}
+	if cfg.LocationDeletePolicy != deletePolicyBlock && cfg.LocationDeletePolicy != deletePolicyTombstone {
+		return fmt.Errorf("unknown location delete policy %q, expected block or tombstone", cfg.LocationDeletePolicy)
+	}
+	return nil
+}
+
+// validateServing reports the settings the server needs besides those of validate.
+// Only serving prices trips, so commands like import run without an Uber token.
+// Ride requests check TRIP_UBER_SANDBOX_TOKEN themselves and are refused without it.
+func (cfg serverConfig) validateServing() error {
+	if cfg.PriceProvider == "uber" && len(cfg.UberServerToken) == 0 {
+		return fmt.Errorf("TRIP_UBER_SERVER_TOKEN is required with the uber price provider, or set TRIP_PRICE_PROVIDER=offline")
+	}
+	return nil
+}
+
+func envString(key string, fallback string) string {
+	if value := os.Getenv(key); len(value) > 0 {
+		return value
+	}
+	return fallback
+}
+
+func envInt(key string, fallback int) int {
+	value, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+func envFloat(key string, fallback float64) float64 {
+	value, err := strconv.ParseFloat(os.Getenv(key), 64)
+	if err != nil {
+		return fallback
+	}
+	return value
+}
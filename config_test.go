@@ -0,0 +1,48 @@
+package main
+
+import "testing"
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(cfg *serverConfig)
+		wantErr bool
+	}{
+		{"defaults", func(cfg *serverConfig) {}, false},
+		{"exact solving disabled", func(cfg *serverConfig) { cfg.MaxExactStops = 0 }, false},
+		{"largest exact trip", func(cfg *serverConfig) { cfg.MaxExactStops = maxExactStopsLimit }, false},
+		{"exact trips too large", func(cfg *serverConfig) { cfg.MaxExactStops = 25 }, true},
+		{"negative exact trips", func(cfg *serverConfig) { cfg.MaxExactStops = -1 }, true},
+		{"tombstones", func(cfg *serverConfig) { cfg.LocationDeletePolicy = deletePolicyTombstone }, false},
+		{"unknown delete policy", func(cfg *serverConfig) { cfg.LocationDeletePolicy = "cascade" }, true},
+	}
+	for _, test := range tests {
+		cfg := loadConfig()
+		test.change(&cfg)
+		if err := cfg.validate(); (err != nil) != test.wantErr {
+			t.Errorf("%s: got error %v, want an error %v", test.name, err, test.wantErr)
+		}
+	}
+}
+
+func TestConfigValidateServing(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(cfg *serverConfig)
+		wantErr bool
+	}{
+		{"uber without a server token", func(cfg *serverConfig) { cfg.PriceProvider, cfg.UberServerToken = "uber", "" }, true},
+		//Only ride requests need the sandbox token
+		{"uber without a sandbox token", func(cfg *serverConfig) {
+			cfg.PriceProvider, cfg.UberServerToken, cfg.UberSandboxToken = "uber", "server", ""
+		}, false},
+		{"offline", func(cfg *serverConfig) { cfg.PriceProvider, cfg.UberServerToken = "offline", "" }, false},
+	}
+	for _, test := range tests {
+		cfg := loadConfig()
+		test.change(&cfg)
+		if err := cfg.validateServing(); (err != nil) != test.wantErr {
+			t.Errorf("%s: got error %v, want an error %v", test.name, err, test.wantErr)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// currencyDigits lists the ISO 4217 currencies whose minor unit is not a hundredth.
+var currencyDigits = map[string]int{
+	"BHD": 3, "CLP": 0, "IQD": 3, "ISK": 0, "JOD": 3, "JPY": 0, "KRW": 0,
+	"KWD": 3, "LYD": 3, "OMR": 3, "PYG": 0, "TND": 3, "UGX": 0, "VND": 0,
+}
+
+var currencySymbols = map[string]string{
+	"USD": "$", "CAD": "CA$", "AUD": "A$", "EUR": "€", "GBP": "£", "INR": "₹", "JPY": "¥",
+}
+
+// minorDigits is the number of decimals of currency, 2 for unknown currencies.
+func minorDigits(currency string) int {
+	if digits, ok := currencyDigits[strings.ToUpper(currency)]; ok {
+		return digits
+	}
+	return 2
+}
+
+// toMinorUnits converts an amount of currency to its minor unit, like cents.
+func toMinorUnits(amount float64, currency string) int64 {
+	return int64(math.Round(amount * math.Pow10(minorDigits(currency))))
+}
+
+// toWholeUnits converts an amount in minor units to the nearest whole amount of currency.
+func toWholeUnits(amount int64, currency string) int {
+	return int(math.Round(float64(amount) / math.Pow10(minorDigits(currency))))
+}
+
+// formatMinorUnits formats an amount in minor units like the Uber estimates, e.g. $12.50.
+func formatMinorUnits(amount int64, currency string) string {
+	digits := minorDigits(currency)
+	formatted := strconv.FormatFloat(float64(amount)/math.Pow10(digits), 'f', digits, 64)
+	if symbol, ok := currencySymbols[strings.ToUpper(currency)]; ok {
+		return symbol + formatted
+	}
+	return strings.ToUpper(currency) + " " + formatted
+}
+
+// formatPriceRange formats a range in minor units, e.g. $12.50-15.75.
+func formatPriceRange(low int64, high int64, currency string) string {
+	if low == high {
+		return formatMinorUnits(low, currency)
+	}
+	digits := minorDigits(currency)
+	return formatMinorUnits(low, currency) + "-" + strconv.FormatFloat(float64(high)/math.Pow10(digits), 'f', digits, 64)
+}
+
+// tripPrice is the price range of a route, summed leg by leg in minor units so the
+// cents of every leg count. Partial is set when some legs have no price, like
+// metered products, and the range only covers the others.
+type tripPrice struct {
+	Low      int64
+	High     int64
+	Currency string
+	Estimate string
+	Partial  bool
+}
+
+// checkCurrencies fails with a 422 when the legs of the matrix are quoted in more
+// than one currency, as their costs could neither be compared nor added up. Legs
+// without a currency are not priced and do not count.
+func (matrix costMatrix) checkCurrencies() error {
+	currencies := make(map[string]bool)
+	for i := range matrix.legs {
+		for j, leg := range matrix.legs[i] {
+			if i != j && len(leg.Currency) > 0 {
+				currencies[strings.ToUpper(leg.Currency)] = true
+			}
+		}
+	}
+	if len(currencies) <= 1 {
+		return nil
+	}
+	codes := make([]string, 0, len(currencies))
+	for code := range currencies {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	return unprocessable("mixed_currencies", "The estimates of the trip are in different currencies and cannot be added up",
+		map[string][]string{"currencies": codes})
+}
+
+// routePrice sums the price range of 0 -> route... -> end. The matrix is in one
+// currency, see checkCurrencies.
+func (matrix costMatrix) routePrice(route []int) tripPrice {
+	var price tripPrice
+	previous := 0
+	for _, next := range matrix.visits(route) {
+		leg := matrix.legs[previous][next]
+		previous = next
+		if len(leg.Currency) == 0 {
+			price.Partial = true
+			continue
+		}
+		price.Currency = strings.ToUpper(leg.Currency)
+		price.Low += toMinorUnits(leg.LowEstimate, price.Currency)
+		price.High += toMinorUnits(leg.HighEstimate, price.Currency)
+	}
+	if len(price.Currency) > 0 {
+		price.Estimate = formatPriceRange(price.Low, price.High, price.Currency)
+	}
+	return price
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestToMinorUnits(t *testing.T) {
+	tests := []struct {
+		amount   float64
+		currency string
+		want     int64
+	}{
+		{12.5, "USD", 1250},
+		{0.29, "USD", 29},
+		{19.99, "usd", 1999},
+		{1234, "JPY", 1234},
+		{1.234, "KWD", 1234},
+		{7.1, "XYZ", 710},
+	}
+	for _, test := range tests {
+		if got := toMinorUnits(test.amount, test.currency); got != test.want {
+			t.Errorf("toMinorUnits(%v, %s) = %d, want %d", test.amount, test.currency, got, test.want)
+		}
+	}
+}
+
+func TestToWholeUnits(t *testing.T) {
+	tests := []struct {
+		amount   int64
+		currency string
+		want     int
+	}{
+		{1250, "USD", 13},
+		{1249, "USD", 12},
+		{18557, "usd", 186},
+		{1234, "JPY", 1234},
+		{1234, "KWD", 1},
+		{0, "", 0},
+	}
+	for _, test := range tests {
+		if got := toWholeUnits(test.amount, test.currency); got != test.want {
+			t.Errorf("toWholeUnits(%d, %s) = %d, want %d", test.amount, test.currency, got, test.want)
+		}
+	}
+}
+
+func TestFormatPriceRange(t *testing.T) {
+	tests := []struct {
+		low      int64
+		high     int64
+		currency string
+		want     string
+	}{
+		{1250, 1575, "USD", "$12.50-15.75"},
+		{700, 700, "USD", "$7.00"},
+		{1200, 1500, "JPY", "¥1200-1500"},
+		{1234, 2000, "KWD", "KWD 1.234-2.000"},
+		{999, 1001, "eur", "€9.99-10.01"},
+	}
+	for _, test := range tests {
+		if got := formatPriceRange(test.low, test.high, test.currency); got != test.want {
+			t.Errorf("formatPriceRange(%d, %d, %s) = %q, want %q", test.low, test.high, test.currency, got, test.want)
+		}
+	}
+}
+
+// pricedMatrix is a round trip over the stops whose every leg is priced low to
+// high in currency, except the legs to the unpriced locations.
+func pricedMatrix(stops int, low float64, high float64, currency string, unpriced map[int]bool) costMatrix {
+	matrix := costMatrix{locations: make([]locationStruct, stops+1), legs: make([][]legEstimate, stops+1)}
+	for i := range matrix.legs {
+		matrix.legs[i] = make([]legEstimate, stops+1)
+		for j := range matrix.legs[i] {
+			if i != j && !unpriced[j] {
+				matrix.legs[i][j] = legEstimate{LowEstimate: low, HighEstimate: high, Currency: currency}
+			}
+		}
+	}
+	return matrix
+}
+
+func TestRoutePrice(t *testing.T) {
+	tests := []struct {
+		name   string
+		matrix costMatrix
+		want   tripPrice
+	}{
+		{"cents add up", pricedMatrix(2, 10.29, 12.01, "USD", nil), tripPrice{Low: 3087, High: 3603, Currency: "USD", Estimate: "$30.87-36.03"}},
+		{"lower case currency", pricedMatrix(1, 5, 5, "cad", nil), tripPrice{Low: 1000, High: 1000, Currency: "CAD", Estimate: "CA$10.00"}},
+		{"metered leg", pricedMatrix(2, 8, 9, "USD", map[int]bool{2: true}), tripPrice{Low: 1600, High: 1800, Currency: "USD", Estimate: "$16.00-18.00", Partial: true}},
+		{"nothing priced", pricedMatrix(1, 8, 9, "USD", map[int]bool{0: true, 1: true}), tripPrice{Partial: true}},
+	}
+	for _, test := range tests {
+		route := test.matrix.stops()
+		if got := test.matrix.routePrice(route); got != test.want {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestCheckCurrencies(t *testing.T) {
+	mixed := pricedMatrix(2, 10, 12, "USD", nil)
+	mixed.legs[1][2].Currency = "EUR"
+	unpriced := pricedMatrix(2, 10, 12, "usd", map[int]bool{2: true})
+	unpriced.legs[0][1].Currency = "USD"
+
+	tests := []struct {
+		name           string
+		matrix         costMatrix
+		wantCurrencies []string
+	}{
+		{"one currency", pricedMatrix(3, 10, 12, "USD", nil), nil},
+		{"unpriced legs", unpriced, nil},
+		{"mixed", mixed, []string{"EUR", "USD"}},
+	}
+	for _, test := range tests {
+		err := test.matrix.checkCurrencies()
+		if test.wantCurrencies == nil {
+			if err != nil {
+				t.Errorf("%s: %v", test.name, err)
+			}
+			continue
+		}
+		apiErr, ok := err.(*apiError)
+		if !ok || apiErr.Status != http.StatusUnprocessableEntity || apiErr.Code != "mixed_currencies" {
+			t.Errorf("%s: got error %v, want mixed_currencies", test.name, err)
+			continue
+		}
+		currencies := apiErr.Details.(map[string][]string)["currencies"]
+		if len(currencies) != len(test.wantCurrencies) || currencies[0] != test.wantCurrencies[0] || currencies[1] != test.wantCurrencies[1] {
+			t.Errorf("%s: got currencies %v, want %v", test.name, currencies, test.wantCurrencies)
+		}
+	}
+}
+
+// currencyEstimator quotes the offline fare in euros for rides to the north of the
+// equator and in dollars otherwise.
+type currencyEstimator struct {
+	offline offlinePriceEstimator
+}
+
+func (estimator currencyEstimator) Estimate(start locationStruct, end locationStruct, product string) (legEstimate, error) {
+	estimate, err := estimator.offline.Estimate(start, end, product)
+	if end.Coordinate.Lat > 0 {
+		estimate.Currency = "EUR"
+	}
+	return estimate, err
+}
+
+func TestBuildCostMatrixRejectsMixedCurrencies(t *testing.T) {
+	locations := make([]locationStruct, 3)
+	locations[1].Coordinate.Lat, locations[2].Coordinate.Lat = -0.1, -0.2
+	objective := tripObjective{Name: objectiveCheapest, Weights: ObjectiveWeights{Cost: 1}}
+
+	if _, err := buildCostMatrix(currencyEstimator{offlinePriceEstimator{rates: testRates}}, locations, objective); err != nil {
+		t.Errorf("a trip priced in dollars failed with %v", err)
+	}
+	locations[2].Coordinate.Lat = 0.2
+	_, err := buildCostMatrix(currencyEstimator{offlinePriceEstimator{rates: testRates}}, locations, objective)
+	if apiErr, ok := err.(*apiError); !ok || apiErr.Code != "mixed_currencies" {
+		t.Errorf("a trip priced in dollars and euros got error %v, want mixed_currencies", err)
+	}
+}
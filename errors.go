@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// apiError is an error with the HTTP status and the JSON body returned to the client.
+type apiError struct {
+	Status  int         `json:"-"`
+	Code    string      `json:"code"`
+	Message string      `json:"message"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+func (err *apiError) Error() string {
+	return fmt.Sprintf("%s: %s", err.Code, err.Message)
+}
+
+func newAPIError(status int, code string, message string, details interface{}) *apiError {
+	return &apiError{Status: status, Code: code, Message: message, Details: details}
+}
+
+func badRequest(code string, message string, details interface{}) *apiError {
+	return newAPIError(http.StatusBadRequest, code, message, details)
+}
+
+func notFound(code string, message string, details interface{}) *apiError {
+	return newAPIError(http.StatusNotFound, code, message, details)
+}
+
+func conflict(code string, message string, details interface{}) *apiError {
+	return newAPIError(http.StatusConflict, code, message, details)
+}
+
+func unprocessable(code string, message string, details interface{}) *apiError {
+	return newAPIError(http.StatusUnprocessableEntity, code, message, details)
+}
+
+// upstreamError reports a failure of one of the services we depend on, like Uber or the geocoder.
+func upstreamError(service string, err error) *apiError {
+	return newAPIError(http.StatusBadGateway, "upstream_error", err.Error(), map[string]string{"service": service})
+}
+
+// toAPIError maps the errors of the store and the helpers to their HTTP form.
+// Anything unexpected becomes a 500 so that a single bad request never takes
+// the server down.
+func toAPIError(err error) *apiError {
+	switch e := err.(type) {
+	case *apiError:
+		return e
+	case errInvalidID:
+		return badRequest("invalid_id", e.Error(), map[string]string{"id": string(e)})
+	}
+	switch err {
+	case errNotFound:
+		return notFound("not_found", "The requested resource does not exist", nil)
+	case errDuplicate:
+		return conflict("duplicate", "A resource with this ID already exists", nil)
+	case errVersionConflict:
+		return newAPIError(http.StatusPreconditionFailed, "version_conflict", "The resource was changed by another request, fetch it again and retry", nil)
+	}
+	return newAPIError(http.StatusInternalServerError, "internal_error", err.Error(), nil)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	apiErr := toAPIError(err)
+	fmt.Println("Request failed : ", apiErr)
+	writeJSON(w, apiErr.Status, apiErr)
+}
+
+func writeJSON(w http.ResponseWriter, status int, output interface{}) {
+	outputJSON, err := json.Marshal(output)
+	if err != nil {
+		fmt.Println("Unable to marshal response : ", err)
+		status = http.StatusInternalServerError
+		outputJSON = []byte(`{"code": "internal_error", "message": "Unable to marshal response"}`)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(outputJSON)
+}
+
+// decodeJSON reads the request body into output, reporting malformed bodies as a 400.
+func decodeJSON(r *http.Request, output interface{}) error {
+	err := json.NewDecoder(r.Body).Decode(output)
+	if err != nil {
+		return badRequest("invalid_json", "Unable to decode the request body", err.Error())
+	}
+	return nil
+}
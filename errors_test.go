@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestToAPIError(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		wantStatus int
+		wantCode   string
+	}{
+		{"api error", unprocessable("empty_trip", "The trip has no stops", nil), http.StatusUnprocessableEntity, "empty_trip"},
+		{"invalid ID", errInvalidID("42"), http.StatusBadRequest, "invalid_id"},
+		{"not found", errNotFound, http.StatusNotFound, "not_found"},
+		{"duplicate", errDuplicate, http.StatusConflict, "duplicate"},
+		{"version conflict", errVersionConflict, http.StatusPreconditionFailed, "version_conflict"},
+		{"upstream", upstreamError("uber", errors.New("timeout")), http.StatusBadGateway, "upstream_error"},
+		{"anything else", errors.New("disk full"), http.StatusInternalServerError, "internal_error"},
+	}
+	for _, test := range tests {
+		if apiErr := toAPIError(test.err); apiErr.Status != test.wantStatus || apiErr.Code != test.wantCode {
+			t.Errorf("%s: got %d %s, want %d %s", test.name, apiErr.Status, apiErr.Code, test.wantStatus, test.wantCode)
+		}
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	writeError(recorder, errInvalidID("42"))
+	if recorder.Code != http.StatusBadRequest || recorder.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("got status %d and content type %q", recorder.Code, recorder.Header().Get("Content-Type"))
+	}
+	var body struct {
+		Status  int               `json:"status"`
+		Code    string            `json:"code"`
+		Message string            `json:"message"`
+		Details map[string]string `json:"details"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	//The status is only sent as the response status
+	if body.Status != 0 || body.Code != "invalid_id" || len(body.Message) == 0 || body.Details["id"] != "42" {
+		t.Errorf("got body %s", recorder.Body.String())
+	}
+
+	recorder = httptest.NewRecorder()
+	writeJSON(recorder, http.StatusOK, func() {})
+	if recorder.Code != http.StatusInternalServerError || !strings.Contains(recorder.Body.String(), "internal_error") {
+		t.Errorf("an unmarshalable response got status %d and body %s", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestHandlersReportErrors(t *testing.T) {
+	server, stop := newTestServer(t)
+	defer stop()
+	unknown := bson.NewObjectId().Hex()
+
+	tests := []struct {
+		method     string
+		path       string
+		body       string
+		wantStatus int
+		wantCode   string
+	}{
+		{"GET", "/locations/42", "", http.StatusBadRequest, "invalid_id"},
+		{"GET", "/locations/" + unknown, "", http.StatusNotFound, "not_found"},
+		{"GET", "/trips/42", "", http.StatusBadRequest, "invalid_id"},
+		{"GET", "/trips/" + unknown, "", http.StatusNotFound, "not_found"},
+		{"POST", "/locations/", `{"name": "Office"`, http.StatusBadRequest, "invalid_json"},
+		{"POST", "/trips/", `["not", "a", "trip"]`, http.StatusBadRequest, "invalid_json"},
+		{"POST", "/trips/", `{"starting_from_location_id": "` + unknown + `", "location_ids": ["` + bson.NewObjectId().Hex() + `"]}`, http.StatusUnprocessableEntity, "unknown_locations"},
+	}
+	for _, test := range tests {
+		request, err := http.NewRequest(test.method, server.URL+test.path, strings.NewReader(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body apiError
+		err = json.NewDecoder(response.Body).Decode(&body)
+		response.Body.Close()
+		if err != nil || response.StatusCode != test.wantStatus || body.Code != test.wantCode {
+			t.Errorf("%s %s: got %d %q, %v, want %d %q", test.method, test.path, response.StatusCode, body.Code, err, test.wantStatus, test.wantCode)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// versionETag is the strong ETag of a stored document at version.
+func versionETag(version int) string {
+	return `"` + strconv.Itoa(version) + `"`
+}
+
+// checkIfMatch fails with a 412 when the If-Match header of the request does not
+// name the current version, and with a 428 when the request has none, so that a
+// client that never fetched the document cannot overwrite a change it did not see.
+func checkIfMatch(r *http.Request, version int) error {
+	header := r.Header.Get("If-Match")
+	if len(header) == 0 {
+		return newAPIError(http.StatusPreconditionRequired, "missing_if_match", "The request must send the ETag of the resource in If-Match, or * to skip the check", nil)
+	}
+	current := versionETag(version)
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || tag == current {
+			return nil
+		}
+	}
+	return newAPIError(http.StatusPreconditionFailed, "version_conflict", "The resource was changed since it was fetched, fetch it again and retry",
+		map[string]string{"if_match": header, "etag": current})
+}
+
+func writeVersionedJSON(w http.ResponseWriter, status int, version int, output interface{}) {
+	w.Header().Set("ETag", versionETag(version))
+	writeJSON(w, status, output)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestCheckIfMatch(t *testing.T) {
+	tests := []struct {
+		header     string
+		wantStatus int
+	}{
+		{`"3"`, 0},
+		{`"1", "3"`, 0},
+		{`*`, 0},
+		{`"2"`, http.StatusPreconditionFailed},
+		{`3`, http.StatusPreconditionFailed},
+		{`W/"3"`, http.StatusPreconditionFailed},
+		{``, http.StatusPreconditionRequired},
+	}
+	for _, test := range tests {
+		request, _ := http.NewRequest("PUT", "/locations/1", nil)
+		if len(test.header) > 0 {
+			request.Header.Set("If-Match", test.header)
+		}
+		err := checkIfMatch(request, 3)
+		if test.wantStatus == 0 {
+			if err != nil {
+				t.Errorf("%q: %v", test.header, err)
+			}
+			continue
+		}
+		if apiErr, ok := err.(*apiError); !ok || apiErr.Status != test.wantStatus {
+			t.Errorf("%q: got %v, want status %d", test.header, err, test.wantStatus)
+		}
+	}
+}
+
+func TestLocationChangesRequireIfMatch(t *testing.T) {
+	server, stop := newTestServer(t)
+	defer stop()
+	id := addTestLocation(t, server, "Office", "94105")
+	replacement := map[string]string{"name": "Office", "address": "1 Main St", "zip": "94105"}
+
+	for _, method := range []string{"PUT", "PATCH", "DELETE"} {
+		var failed apiError
+		status, _ := sendJSONWithHeader(t, server, method, "/locations/"+id, nil, replacement, &failed)
+		if status != http.StatusPreconditionRequired || failed.Code != "missing_if_match" {
+			t.Errorf("%s without If-Match got %d %q", method, status, failed.Code)
+		}
+		status, _ = sendJSONWithHeader(t, server, method, "/locations/"+id, http.Header{"If-Match": {`"7"`}}, replacement, &failed)
+		if status != http.StatusPreconditionFailed || failed.Code != "version_conflict" {
+			t.Errorf("%s with a stale If-Match got %d %q", method, status, failed.Code)
+		}
+	}
+	var location locationStruct
+	if status := sendJSON(t, server, "GET", "/locations/"+id, nil, &location); status != http.StatusOK || location.Version != 1 {
+		t.Errorf("the rejected changes left %d, version %d", status, location.Version)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// locationExporter writes locations in one file format.
+type locationExporter struct {
+	ContentType string
+	Extension   string
+	Write       func(output io.Writer, locations []locationStruct) error
+}
+
+var locationExporters = map[string]locationExporter{
+	"geojson": {"application/geo+json", "geojson", writeGeoJSON},
+	"kml":     {"application/vnd.google-earth.kml+xml", "kml", writeKML},
+	"gpx":     {"application/gpx+xml", "gpx", writeGPX},
+	"csv":     {"text/csv", "csv", writeCSV},
+}
+
+func writeGeoJSON(output io.Writer, locations []locationStruct) error {
+	collection := geoJSONFeatureCollection{Type: "FeatureCollection", Features: make([]geoJSONFeature, len(locations))}
+	for i, location := range locations {
+		feature := &collection.Features[i]
+		feature.Type = "Feature"
+		feature.Geometry = &struct {
+			Type        string    `json:"type"`
+			Coordinates []float64 `json:"coordinates"`
+		}{"Point", []float64{location.Coordinate.Lng, location.Coordinate.Lat}}
+		feature.Properties.ID = location.ID.Hex()
+		feature.Properties.Name = location.Name
+		feature.Properties.Address = location.Address
+		feature.Properties.City = location.City
+		feature.Properties.State = location.State
+		feature.Properties.Zip = location.Zip
+		feature.Properties.Tags = location.Tags
+		feature.Properties.Category = location.Category
+		feature.Properties.Notes = location.Notes
+		feature.Properties.Owner = location.Owner
+	}
+	return json.NewEncoder(output).Encode(collection)
+}
+
+type kmlDocument struct {
+	XMLName    xml.Name       `xml:"http://www.opengis.net/kml/2.2 kml"`
+	Name       string         `xml:"Document>name"`
+	Placemarks []kmlPlacemark `xml:"Document>Placemark"`
+}
+
+type kmlPlacemark struct {
+	ID          string `xml:"id,attr"`
+	Name        string `xml:"name"`
+	Address     string `xml:"address"`
+	Coordinates string `xml:"Point>coordinates"`
+}
+
+func writeKML(output io.Writer, locations []locationStruct) error {
+	document := kmlDocument{Name: "Locations", Placemarks: make([]kmlPlacemark, len(locations))}
+	for i, location := range locations {
+		document.Placemarks[i] = kmlPlacemark{
+			ID:      location.ID.Hex(),
+			Name:    location.Name,
+			Address: newGeocodeQuery(location).String(),
+			//KML coordinates are longitude,latitude
+			Coordinates: formatCoordinate(location.Coordinate.Lng) + "," + formatCoordinate(location.Coordinate.Lat),
+		}
+	}
+	return writeXML(output, document)
+}
+
+type gpxDocument struct {
+	XMLName   xml.Name      `xml:"http://www.topografix.com/GPX/1/1 gpx"`
+	Version   string        `xml:"version,attr"`
+	Creator   string        `xml:"creator,attr"`
+	Waypoints []gpxWaypoint `xml:"wpt"`
+}
+
+type gpxWaypoint struct {
+	Lat  string `xml:"lat,attr"`
+	Lon  string `xml:"lon,attr"`
+	Name string `xml:"name"`
+	Desc string `xml:"desc"`
+}
+
+func writeGPX(output io.Writer, locations []locationStruct) error {
+	document := gpxDocument{Version: "1.1", Creator: "Uber_Trip_Requester", Waypoints: make([]gpxWaypoint, len(locations))}
+	for i, location := range locations {
+		document.Waypoints[i] = gpxWaypoint{
+			Lat:  formatCoordinate(location.Coordinate.Lat),
+			Lon:  formatCoordinate(location.Coordinate.Lng),
+			Name: location.Name,
+			Desc: newGeocodeQuery(location).String(),
+		}
+	}
+	return writeXML(output, document)
+}
+
+func writeXML(output io.Writer, document interface{}) error {
+	_, err := io.WriteString(output, xml.Header)
+	if err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(output)
+	encoder.Indent("", "  ")
+	return encoder.Encode(document)
+}
+
+// writeCSV uses the columns of the CSV import, with the ID last, so an export can be imported again.
+func writeCSV(output io.Writer, locations []locationStruct) error {
+	writer := csv.NewWriter(output)
+	header := append(append([]string(nil), importColumns...), "id")
+	writer.Write(header)
+	for _, location := range locations {
+		writer.Write([]string{location.Name, location.Address, location.City, location.State, location.Zip,
+			formatCoordinate(location.Coordinate.Lat), formatCoordinate(location.Coordinate.Lng),
+			strings.Join(location.Tags, importTagSeparator), location.Category, location.Notes, location.Owner, location.ID.Hex()})
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+func formatCoordinate(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+// exportLocations serves GET /locations/export?format=, taking the same filters and
+// sort as the location list but returning every match.
+func exportLocations(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if len(format) == 0 {
+		format = "geojson"
+	}
+	exporter, ok := locationExporters[format]
+	if !ok {
+		writeError(w, badRequest("invalid_format", "format must be geojson, kml, gpx or csv", map[string]string{"format": format}))
+		return
+	}
+	query, err := parseLocationQuery(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	locations := make([]locationStruct, 0)
+	err = forEachLocation(query, func(location locationStruct) bool {
+		locations = append(locations, location)
+		return true
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", exporter.ContentType)
+	w.Header().Set("Content-Disposition", `attachment; filename="locations.`+exporter.Extension+`"`)
+	w.WriteHeader(http.StatusOK)
+	err = exporter.Write(w, locations)
+	if err != nil {
+		//The status is already sent, all that is left is to log the failure
+		fmt.Println("Unable to write the export : ", err)
+	}
+}
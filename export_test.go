@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// exportedLocations are two locations, one with characters that need escaping in XML.
+func exportedLocations() []locationStruct {
+	office := locationStruct{ID: bson.NewObjectId(), Name: "Office", Address: "1 Market St", City: "San Francisco", State: "CA", Zip: "94105",
+		Tags: []string{"work", "hq"}, Category: "work", Notes: "Ring twice", Owner: "ops"}
+	office.Coordinate.Lat, office.Coordinate.Lng = 37.7898, -122.3942
+	lab := locationStruct{ID: bson.NewObjectId(), Name: "R&D <Lab>", Address: `3 "University" Ave`, City: "Palo Alto", State: "CA", Zip: "94301"}
+	lab.Coordinate.Lat, lab.Coordinate.Lng = 37.4443, -122.1598
+	return []locationStruct{office, lab}
+}
+
+func TestWriteGeoJSON(t *testing.T) {
+	locations := exportedLocations()
+	var output bytes.Buffer
+	if err := writeGeoJSON(&output, locations); err != nil {
+		t.Fatal(err)
+	}
+	var collection geoJSONFeatureCollection
+	if err := json.Unmarshal(output.Bytes(), &collection); err != nil {
+		t.Fatal(err)
+	}
+	if collection.Type != "FeatureCollection" || len(collection.Features) != 2 {
+		t.Fatalf("got %s", output.String())
+	}
+	office, feature := locations[0], collection.Features[0]
+	//GeoJSON positions are longitude first
+	if feature.Type != "Feature" || feature.Geometry.Type != "Point" || feature.Geometry.Coordinates[0] != office.Coordinate.Lng || feature.Geometry.Coordinates[1] != office.Coordinate.Lat {
+		t.Errorf("got feature %+v", feature)
+	}
+	properties := feature.Properties
+	if properties.ID != office.ID.Hex() || properties.Name != office.Name || properties.Zip != office.Zip || len(properties.Tags) != 2 ||
+		properties.Category != office.Category || properties.Notes != office.Notes || properties.Owner != office.Owner {
+		t.Errorf("got properties %+v", properties)
+	}
+}
+
+func TestWriteKML(t *testing.T) {
+	locations := exportedLocations()
+	var output bytes.Buffer
+	if err := writeKML(&output, locations); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(output.Bytes(), []byte(xml.Header)) {
+		t.Errorf("the KML starts with %.40q", output.String())
+	}
+	var document kmlDocument
+	if err := xml.Unmarshal(output.Bytes(), &document); err != nil {
+		t.Fatal(err)
+	}
+	if len(document.Placemarks) != 2 {
+		t.Fatalf("got %s", output.String())
+	}
+	lab := document.Placemarks[1]
+	if lab.ID != locations[1].ID.Hex() || lab.Name != "R&D <Lab>" || lab.Address != `3 "University" Ave, Palo Alto, CA, 94301` || lab.Coordinates != "-122.1598,37.4443" {
+		t.Errorf("got placemark %+v", lab)
+	}
+}
+
+func TestWriteGPX(t *testing.T) {
+	locations := exportedLocations()
+	var output bytes.Buffer
+	if err := writeGPX(&output, locations); err != nil {
+		t.Fatal(err)
+	}
+	var document gpxDocument
+	if err := xml.Unmarshal(output.Bytes(), &document); err != nil {
+		t.Fatal(err)
+	}
+	if document.Version != "1.1" || len(document.Waypoints) != 2 {
+		t.Fatalf("got %s", output.String())
+	}
+	office := document.Waypoints[0]
+	if office.Lat != "37.7898" || office.Lon != "-122.3942" || office.Name != "Office" || office.Desc != "1 Market St, San Francisco, CA, 94105" {
+		t.Errorf("got waypoint %+v", office)
+	}
+}
+
+func TestWriteCSV(t *testing.T) {
+	locations := exportedLocations()
+	var output bytes.Buffer
+	if err := writeCSV(&output, locations); err != nil {
+		t.Fatal(err)
+	}
+	records, err := csv.NewReader(&output).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 || len(records[0]) != len(importColumns)+1 || records[0][0] != "name" || records[0][len(importColumns)] != "id" {
+		t.Fatalf("got %v", records)
+	}
+	office := records[1]
+	if office[0] != "Office" || office[5] != "37.7898" || office[6] != "-122.3942" || office[7] != "work;hq" || office[11] != locations[0].ID.Hex() {
+		t.Errorf("got row %v", office)
+	}
+	if records[2][1] != `3 "University" Ave` {
+		t.Errorf("the quoted address came back as %q", records[2][1])
+	}
+}
+
+func TestExportLocationsHandler(t *testing.T) {
+	server, stop := newTestServer(t)
+	defer stop()
+	//More locations than fit in a page of the store
+	for i := 0; i < maxPageSize+5; i++ {
+		location := testLocation("Stop "+strconv.Itoa(i), 1)
+		if i%2 == 0 {
+			location.City = "San Francisco"
+		}
+		if err := store.InsertLocation(location); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		path            string
+		wantContentType string
+		wantFeatures    int
+	}{
+		{"/locations/export", "application/geo+json", maxPageSize + 5},
+		{"/locations/export?format=geojson&city=san+francisco", "application/geo+json", (maxPageSize + 6) / 2},
+		{"/locations/export?format=kml", "application/vnd.google-earth.kml+xml", 0},
+		{"/locations/export?format=gpx", "application/gpx+xml", 0},
+		{"/locations/export?format=csv", "text/csv", 0},
+	}
+	for _, test := range tests {
+		response, err := http.Get(server.URL + test.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		if response.StatusCode != http.StatusOK || response.Header.Get("Content-Type") != test.wantContentType {
+			t.Errorf("%s: got status %d and content type %q", test.path, response.StatusCode, response.Header.Get("Content-Type"))
+			continue
+		}
+		if disposition := response.Header.Get("Content-Disposition"); len(disposition) == 0 {
+			t.Errorf("%s: no attachment file name", test.path)
+		}
+		if test.wantFeatures == 0 {
+			continue
+		}
+		var collection geoJSONFeatureCollection
+		if err := json.Unmarshal(body, &collection); err != nil || len(collection.Features) != test.wantFeatures {
+			t.Errorf("%s: got %d features, %v, want %d", test.path, len(collection.Features), err, test.wantFeatures)
+		}
+	}
+
+	var failed apiError
+	if status := sendJSON(t, server, "GET", "/locations/export?format=shp", nil, &failed); status != http.StatusBadRequest || failed.Code != "invalid_format" {
+		t.Errorf("an unknown format got %d %q", status, failed.Code)
+	}
+	if status := sendJSON(t, server, "GET", "/locations/export?format=csv&sort=address", nil, &failed); status != http.StatusBadRequest || failed.Code != "invalid_sort" {
+		t.Errorf("an invalid sort got %d %q", status, failed.Code)
+	}
+}
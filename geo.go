@@ -0,0 +1,17 @@
+package main
+
+import (
+	"math"
+)
+
+const earthRadiusMiles float64 = 3958.8
+
+// haversineMiles is the great-circle distance between two coordinates.
+func haversineMiles(lat1 float64, lng1 float64, lat2 float64, lng2 float64) float64 {
+	toRadians := math.Pi / 180
+	dLat := (lat2 - lat1) * toRadians
+	dLng := (lng2 - lng1) * toRadians
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*toRadians)*math.Cos(lat2*toRadians)*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadiusMiles * math.Asin(math.Min(1, math.Sqrt(a)))
+}
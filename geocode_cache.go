@@ -0,0 +1,192 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// geocodeCacheEntry is a remembered forward geocoding answer. Addresses without a
+// match are cached too, as looking them up again costs the same quota.
+type geocodeCacheEntry struct {
+	Key      string          `json:"key" bson:"_id"`
+	Provider string          `json:"provider" bson:"provider"`
+	Query    geocodeQuery    `json:"query" bson:"query"`
+	Results  []geocodeResult `json:"results" bson:"results"`
+	CachedAt time.Time       `json:"cached_at" bson:"cached_at"`
+}
+
+// geocodeCacheKey normalizes the query so that addresses differing only in case
+// or spacing share an entry. Entries are kept per provider.
+func geocodeCacheKey(provider string, query geocodeQuery) string {
+	parts := []string{provider, query.Address, query.City, query.State, query.Zip}
+	for i, part := range parts {
+		parts[i] = strings.ToLower(strings.Join(strings.Fields(part), " "))
+	}
+	return strings.Join(parts, "|")
+}
+
+// cachingGeocoder is a geocoder that answers forward lookups from the store while
+// they are younger than ttl and asks next otherwise. Reverse lookups, which are
+// rare, always go to next.
+type cachingGeocoder struct {
+	store  geocodeCacheStore
+	ttl    time.Duration
+	next   geocoder
+	hits   uint64
+	misses uint64
+}
+
+func newCachingGeocoder(store geocodeCacheStore, ttl time.Duration, next geocoder) *cachingGeocoder {
+	return &cachingGeocoder{store: store, ttl: ttl, next: next}
+}
+
+func (cache *cachingGeocoder) Name() string {
+	return cache.next.Name()
+}
+
+func (cache *cachingGeocoder) Geocode(query geocodeQuery) ([]geocodeResult, error) {
+	results, _, err := cache.lookup(query, false)
+	return results, err
+}
+
+func (cache *cachingGeocoder) ReverseGeocode(lat float64, lng float64) ([]geocodeResult, error) {
+	return cache.next.ReverseGeocode(lat, lng)
+}
+
+// lookup geocodes query, reporting whether the answer came from the cache. refresh
+// skips the cached entry and replaces it. A failing cache only costs a call to next.
+func (cache *cachingGeocoder) lookup(query geocodeQuery, refresh bool) ([]geocodeResult, bool, error) {
+	key := geocodeCacheKey(cache.Name(), query)
+	if !refresh {
+		entry, err := cache.store.FindGeocode(key)
+		if err == nil && time.Since(entry.CachedAt) < cache.ttl {
+			atomic.AddUint64(&cache.hits, 1)
+			return entry.Results, true, nil
+		}
+	}
+	atomic.AddUint64(&cache.misses, 1)
+
+	results, err := cache.next.Geocode(query)
+	if err != nil {
+		return nil, false, err
+	}
+	if results == nil {
+		results = []geocodeResult{}
+	}
+	cache.store.SaveGeocode(geocodeCacheEntry{Key: key, Provider: cache.Name(), Query: query, Results: results, CachedAt: time.Now()})
+	return results, false, nil
+}
+
+type geocodeCacheStats struct {
+	Provider   string `json:"provider"`
+	TTLSeconds int64  `json:"ttl_seconds"`
+	Entries    int    `json:"entries"`
+	Hits       uint64 `json:"hits"`
+	Misses     uint64 `json:"misses"`
+}
+
+type geocodeWarmResult struct {
+	Address string `json:"address"`
+	Cached  bool   `json:"cached"`
+	Results int    `json:"results"`
+	Error   string `json:"error,omitempty"`
+}
+
+// cachingLocationGeocoder returns the geocode cache in front of locationGeocoder, or
+// a 404 when caching is disabled.
+func cachingLocationGeocoder() (*cachingGeocoder, error) {
+	cache, ok := locationGeocoder.(*cachingGeocoder)
+	if !ok {
+		return nil, notFound("cache_disabled", "The geocode cache is disabled", nil)
+	}
+	return cache, nil
+}
+
+// getGeocodeCacheStats serves GET /admin/geocode-cache with the counters since startup.
+func getGeocodeCacheStats(w http.ResponseWriter, r *http.Request) {
+	cache, err := cachingLocationGeocoder()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	entries, err := cache.store.CountGeocodes()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, geocodeCacheStats{
+		Provider:   cache.Name(),
+		TTLSeconds: int64(cache.ttl / time.Second),
+		Entries:    entries,
+		Hits:       atomic.LoadUint64(&cache.hits),
+		Misses:     atomic.LoadUint64(&cache.misses),
+	})
+}
+
+// purgeGeocodeCache serves DELETE /admin/geocode-cache. The address, city, state
+// and zip parameters purge a single address, expired=true only the expired
+// entries, and no parameters everything.
+func purgeGeocodeCache(w http.ResponseWriter, r *http.Request) {
+	cache, err := cachingLocationGeocoder()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	params := r.URL.Query()
+	query := geocodeQuery{Address: params.Get("address"), City: params.Get("city"), State: params.Get("state"), Zip: params.Get("zip")}
+
+	var purged int
+	if !query.isEmpty() {
+		err = cache.store.DeleteGeocode(geocodeCacheKey(cache.Name(), query))
+		if err == nil {
+			purged = 1
+		} else if err == errNotFound {
+			err = nil
+		}
+	} else if params.Get("expired") == "true" {
+		purged, err = cache.store.PurgeGeocodes(time.Now().Add(-cache.ttl))
+	} else {
+		purged, err = cache.store.PurgeGeocodes(time.Now())
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"purged": purged})
+}
+
+// warmGeocodeCache serves POST /admin/geocode-cache/warm with a JSON array of
+// addresses, geocoding the ones not cached yet. refresh=true geocodes all of them again.
+func warmGeocodeCache(w http.ResponseWriter, r *http.Request) {
+	cache, err := cachingLocationGeocoder()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	var addresses []locationStruct
+	err = decodeJSON(r, &addresses)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	refresh := r.URL.Query().Get("refresh") == "true"
+	warmed := make([]geocodeWarmResult, len(addresses))
+	for i, address := range addresses {
+		query := newGeocodeQuery(address)
+		warmed[i].Address = query.String()
+		if query.isEmpty() {
+			warmed[i].Error = "An address, city, state or zip is required"
+			continue
+		}
+		results, cached, err := cache.lookup(query, refresh)
+		if err != nil {
+			warmed[i].Error = err.Error()
+			continue
+		}
+		warmed[i].Cached, warmed[i].Results = cached, len(results)
+	}
+	writeJSON(w, http.StatusOK, warmed)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestGeocodeCacheKey(t *testing.T) {
+	key := geocodeCacheKey("google", geocodeQuery{Address: "1 Market St", City: "San Francisco", Zip: "94105"})
+	if same := geocodeCacheKey("google", geocodeQuery{Address: " 1  market ST", City: "SAN FRANCISCO ", Zip: "94105"}); same != key {
+		t.Errorf("%q and %q differ only in case and spacing", key, same)
+	}
+	if other := geocodeCacheKey("nominatim", geocodeQuery{Address: "1 Market St", City: "San Francisco", Zip: "94105"}); other == key {
+		t.Error("two providers share a key")
+	}
+	//The fields are kept apart, so moving a word between them changes the key
+	if other := geocodeCacheKey("google", geocodeQuery{Address: "1 Market St San Francisco", Zip: "94105"}); other == key {
+		t.Error("different fields share a key")
+	}
+}
+
+func TestCachingGeocoder(t *testing.T) {
+	memory := newMemoryStore("")
+	next := &stubGeocoder{results: map[string][]geocodeResult{"1 Market St, San Francisco": {testZips["94105"]}}}
+	cache := newCachingGeocoder(memory, time.Hour, next)
+	query := geocodeQuery{Address: "1 Market St", City: "San Francisco"}
+
+	for i := 0; i < 3; i++ {
+		results, err := cache.Geocode(query)
+		if err != nil || len(results) != 1 || results[0] != testZips["94105"] {
+			t.Fatalf("lookup %d got %+v, %v", i, results, err)
+		}
+	}
+	if next.geocodes != 1 || cache.hits != 2 || cache.misses != 1 {
+		t.Errorf("three lookups made %d calls, %d hits and %d misses", next.geocodes, cache.hits, cache.misses)
+	}
+
+	//Addresses without a match are remembered too
+	nowhere := geocodeQuery{City: "Nowhere"}
+	cache.Geocode(nowhere)
+	if results, err := cache.Geocode(nowhere); err != nil || results == nil || len(results) != 0 || next.geocodes != 2 {
+		t.Errorf("the unknown address got %+v, %v after %d calls", results, err, next.geocodes)
+	}
+
+	//Failures are not
+	next.err = errors.New("quota exceeded")
+	failing := geocodeQuery{City: "Springfield"}
+	if _, err := cache.Geocode(failing); err == nil {
+		t.Error("a failed lookup returned no error")
+	}
+	if _, err := memory.FindGeocode(geocodeCacheKey(next.Name(), failing)); err != errNotFound {
+		t.Errorf("the failed lookup was cached, %v", err)
+	}
+	next.err = nil
+
+	//Entries older than the ttl are looked up again and replaced
+	entry, _ := memory.FindGeocode(geocodeCacheKey(next.Name(), query))
+	entry.CachedAt = time.Now().Add(-2 * time.Hour)
+	memory.SaveGeocode(entry)
+	cache.Geocode(query)
+	if entry, _ = memory.FindGeocode(geocodeCacheKey(next.Name(), query)); next.geocodes != 4 || time.Since(entry.CachedAt) > time.Minute {
+		t.Errorf("the expired entry made %d calls and is cached at %v", next.geocodes, entry.CachedAt)
+	}
+
+	cache.ReverseGeocode(37.79, -122.39)
+	cache.ReverseGeocode(37.79, -122.39)
+	if next.reverses != 2 {
+		t.Errorf("two reverse lookups made %d calls", next.reverses)
+	}
+}
+
+func TestGeocodeCacheAdmin(t *testing.T) {
+	server, stop := newTestServer(t)
+	defer stop()
+
+	var failed apiError
+	if status := sendJSON(t, server, "GET", "/admin/geocode-cache", nil, &failed); status != http.StatusNotFound || failed.Code != "cache_disabled" {
+		t.Errorf("the stats of a disabled cache got %d %q", status, failed.Code)
+	}
+
+	next := &stubGeocoder{results: map[string][]geocodeResult{
+		"1 Market St, 94105": {testZips["94105"]},
+		"1 Main St, 95112":   {testZips["95112"]},
+	}}
+	locationGeocoder = newCachingGeocoder(store, time.Hour, next)
+	addresses := []map[string]string{{"address": "1 Market St", "zip": "94105"}, {"address": "1 Main St", "zip": "95112"}, {"address": "9 Elm St"}, {}}
+
+	var warmed []geocodeWarmResult
+	if status := sendJSON(t, server, "POST", "/admin/geocode-cache/warm", addresses, &warmed); status != http.StatusOK || len(warmed) != 4 {
+		t.Fatalf("got %d %+v", status, warmed)
+	}
+	if warmed[0].Cached || warmed[0].Results != 1 || warmed[2].Results != 0 || len(warmed[3].Error) == 0 {
+		t.Errorf("the first warm up got %+v", warmed)
+	}
+	sendJSON(t, server, "POST", "/admin/geocode-cache/warm", addresses[:1], &warmed)
+	if !warmed[0].Cached {
+		t.Errorf("the second warm up got %+v", warmed)
+	}
+	sendJSON(t, server, "POST", "/admin/geocode-cache/warm?refresh=true", addresses[:1], &warmed)
+	if warmed[0].Cached || next.geocodes != 4 {
+		t.Errorf("the refresh got %+v after %d calls", warmed, next.geocodes)
+	}
+
+	var stats geocodeCacheStats
+	sendJSON(t, server, "GET", "/admin/geocode-cache", nil, &stats)
+	if stats.Provider != "stub" || stats.TTLSeconds != 3600 || stats.Entries != 3 || stats.Hits != 1 || stats.Misses != 4 {
+		t.Errorf("got stats %+v", stats)
+	}
+
+	var purged map[string]int
+	tests := []struct {
+		query       string
+		wantPurged  int
+		wantEntries int
+	}{
+		{"?address=1+market+st&zip=94105", 1, 2},
+		{"?address=1+market+st&zip=94105", 0, 2},
+		{"?expired=true", 0, 2},
+		{"", 2, 0},
+	}
+	for _, test := range tests {
+		if status := sendJSON(t, server, "DELETE", "/admin/geocode-cache"+test.query, nil, &purged); status != http.StatusOK || purged["purged"] != test.wantPurged {
+			t.Errorf("%q: got %d and purged %v, want %d", test.query, status, purged, test.wantPurged)
+		}
+		if entries, _ := store.CountGeocodes(); entries != test.wantEntries {
+			t.Errorf("%q: %d entries are left, want %d", test.query, entries, test.wantEntries)
+		}
+	}
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const googleGeocodeURL string = "https://maps.googleapis.com/maps/api/geocode/json"
+
+// geocodeQuery is the address of a location to resolve.
+type geocodeQuery struct {
+	Address string
+	City    string
+	State   string
+	Zip     string
+}
+
+func newGeocodeQuery(location locationStruct) geocodeQuery {
+	return geocodeQuery{Address: location.Address, City: location.City, State: location.State, Zip: location.Zip}
+}
+
+// String joins the non-empty parts of the query into a single line address.
+func (query geocodeQuery) String() string {
+	parts := make([]string, 0, 4)
+	for _, part := range []string{query.Address, query.City, query.State, query.Zip} {
+		if part = strings.TrimSpace(part); len(part) > 0 {
+			parts = append(parts, part)
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+func (query geocodeQuery) isEmpty() bool {
+	return len(query.String()) == 0
+}
+
+// geocodeResult is one candidate returned by a geocoder, best match first.
+type geocodeResult struct {
+	FormattedAddress string  `json:"formatted_address"`
+	Lat              float64 `json:"lat"`
+	Lng              float64 `json:"lng"`
+	LocationType     string  `json:"location_type"`
+	PartialMatch     bool    `json:"partial_match"`
+	PlaceID          string  `json:"place_id"`
+	Address          string  `json:"address"`
+	City             string  `json:"city"`
+	State            string  `json:"state"`
+	Zip              string  `json:"zip"`
+}
+
+// geocoder resolves an address to coordinates and coordinates back to an address.
+// Anything that cannot be found is not an error and yields no results.
+type geocoder interface {
+	Geocode(query geocodeQuery) ([]geocodeResult, error)
+	ReverseGeocode(lat float64, lng float64) ([]geocodeResult, error)
+	Name() string
+}
+
+// locationGeocoder is the geocoder used by the location handlers, set up in main.
+var locationGeocoder geocoder
+
+func newGeocoder(cfg serverConfig) (geocoder, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	switch cfg.GeocoderProvider {
+	case "google":
+		return googleGeocoder{apiKey: cfg.GoogleAPIKey, client: client}, nil
+	case "nominatim":
+		return nominatimGeocoder{baseURL: cfg.NominatimURL, userAgent: cfg.NominatimUserAgent, client: client}, nil
+	case "gazetteer":
+		return loadGazetteer(cfg.GazetteerCSV)
+	}
+	return nil, fmt.Errorf("unknown geocoder %q, expected google, nominatim or gazetteer", cfg.GeocoderProvider)
+}
+
+// googleGeocoder uses the Google Maps geocoding API.
+type googleGeocoder struct {
+	apiKey string
+	client *http.Client
+}
+
+func (google googleGeocoder) Name() string {
+	return "google"
+}
+
+func (google googleGeocoder) Geocode(query geocodeQuery) ([]geocodeResult, error) {
+	params := url.Values{}
+	params.Set("address", query.String())
+	if len(google.apiKey) > 0 {
+		params.Set("key", google.apiKey)
+	}
+	var googleLocation GoogleLocationStruct
+	err := googleLocation.getGoogleLocation(google.client, googleGeocodeURL+"?"+params.Encode())
+	if err != nil {
+		return nil, err
+	}
+	return googleLocation.geocodeResults(), nil
+}
+
+func (google googleGeocoder) ReverseGeocode(lat float64, lng float64) ([]geocodeResult, error) {
+	params := url.Values{}
+	params.Set("latlng", formatCoordinate(lat)+","+formatCoordinate(lng))
+	if len(google.apiKey) > 0 {
+		params.Set("key", google.apiKey)
+	}
+	var googleLocation GoogleLocationStruct
+	err := googleLocation.getGoogleLocation(google.client, googleGeocodeURL+"?"+params.Encode())
+	if err != nil {
+		return nil, err
+	}
+	return googleLocation.geocodeResults(), nil
+}
+
+func (location *GoogleLocationStruct) getGoogleLocation(client *http.Client, requestURL string) error {
+	res, err := client.Get(requestURL)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(body, location)
+	if err != nil {
+		return fmt.Errorf("unable to unmarshal Google data: %v", err)
+	}
+	if location.Status != "OK" && location.Status != "ZERO_RESULTS" {
+		return fmt.Errorf("Google geocoding failed with status %s", location.Status)
+	}
+	return nil
+}
+
+func (location *GoogleLocationStruct) geocodeResults() []geocodeResult {
+	results := make([]geocodeResult, 0, len(location.Results))
+	for _, googleResult := range location.Results {
+		result := geocodeResult{
+			FormattedAddress: googleResult.FormattedAddress,
+			Lat:              googleResult.Geometry.Location.Lat,
+			Lng:              googleResult.Geometry.Location.Lng,
+			LocationType:     googleResult.Geometry.LocationType,
+			PartialMatch:     googleResult.PartialMatch,
+			PlaceID:          googleResult.PlaceID,
+		}
+		var streetNumber, route string
+		for _, component := range googleResult.AddressComponents {
+			for _, componentType := range component.Types {
+				switch componentType {
+				case "street_number":
+					streetNumber = component.LongName
+				case "route":
+					route = component.LongName
+				case "locality":
+					result.City = component.LongName
+				case "administrative_area_level_1":
+					result.State = component.ShortName
+				case "postal_code":
+					result.Zip = component.LongName
+				}
+			}
+		}
+		result.Address = strings.TrimSpace(streetNumber + " " + route)
+		results = append(results, result)
+	}
+	return results
+}
+
+// nominatimGeocoder uses the search API of Nominatim or a compatible server.
+type nominatimGeocoder struct {
+	baseURL   string
+	userAgent string
+	client    *http.Client
+}
+
+type nominatimPlace struct {
+	PlaceID     json.Number `json:"place_id"`
+	Lat         string      `json:"lat"`
+	Lon         string      `json:"lon"`
+	DisplayName string      `json:"display_name"`
+	Type        string      `json:"type"`
+	Address     struct {
+		HouseNumber string `json:"house_number"`
+		Road        string `json:"road"`
+		City        string `json:"city"`
+		Town        string `json:"town"`
+		Village     string `json:"village"`
+		State       string `json:"state"`
+		Postcode    string `json:"postcode"`
+	} `json:"address"`
+}
+
+func (nominatim nominatimGeocoder) Name() string {
+	return "nominatim"
+}
+
+func (nominatim nominatimGeocoder) Geocode(query geocodeQuery) ([]geocodeResult, error) {
+	params := url.Values{}
+	params.Set("format", "jsonv2")
+	params.Set("addressdetails", "1")
+	//Structured search, empty fields must be left out rather than sent blank
+	for name, value := range map[string]string{"street": query.Address, "city": query.City, "state": query.State, "postalcode": query.Zip} {
+		if value = strings.TrimSpace(value); len(value) > 0 {
+			params.Set(name, value)
+		}
+	}
+	var places []nominatimPlace
+	err := nominatim.get(strings.TrimRight(nominatim.baseURL, "/")+"/search?"+params.Encode(), &places)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]geocodeResult, 0, len(places))
+	for _, place := range places {
+		result, err := place.geocodeResult()
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+func (nominatim nominatimGeocoder) ReverseGeocode(lat float64, lng float64) ([]geocodeResult, error) {
+	params := url.Values{}
+	params.Set("format", "jsonv2")
+	params.Set("addressdetails", "1")
+	params.Set("lat", formatCoordinate(lat))
+	params.Set("lon", formatCoordinate(lng))
+	//Reverse lookups return a single place, or an error object when nothing is there
+	var place struct {
+		nominatimPlace
+		Error string `json:"error"`
+	}
+	err := nominatim.get(strings.TrimRight(nominatim.baseURL, "/")+"/reverse?"+params.Encode(), &place)
+	if err != nil {
+		return nil, err
+	}
+	if len(place.Error) > 0 {
+		return []geocodeResult{}, nil
+	}
+	result, err := place.geocodeResult()
+	if err != nil {
+		return nil, err
+	}
+	return []geocodeResult{result}, nil
+}
+
+func (nominatim nominatimGeocoder) get(requestURL string, output interface{}) error {
+	req, err := http.NewRequest("GET", requestURL, nil)
+	if err != nil {
+		return err
+	}
+	//Nominatim's usage policy requires an identifying user agent
+	req.Header.Set("User-Agent", nominatim.userAgent)
+	res, err := nominatim.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("Nominatim responded with %s", res.Status)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, output)
+}
+
+func (place nominatimPlace) geocodeResult() (geocodeResult, error) {
+	lat, err := strconv.ParseFloat(place.Lat, 64)
+	if err != nil {
+		return geocodeResult{}, fmt.Errorf("invalid latitude %q from Nominatim", place.Lat)
+	}
+	lng, err := strconv.ParseFloat(place.Lon, 64)
+	if err != nil {
+		return geocodeResult{}, fmt.Errorf("invalid longitude %q from Nominatim", place.Lon)
+	}
+	city := place.Address.City
+	if len(city) == 0 {
+		city = place.Address.Town
+	}
+	if len(city) == 0 {
+		city = place.Address.Village
+	}
+	return geocodeResult{
+		FormattedAddress: place.DisplayName,
+		Lat:              lat,
+		Lng:              lng,
+		LocationType:     place.Type,
+		PlaceID:          place.PlaceID.String(),
+		Address:          strings.TrimSpace(place.Address.HouseNumber + " " + place.Address.Road),
+		City:             city,
+		State:            place.Address.State,
+		Zip:              place.Address.Postcode,
+	}, nil
+}
+
+const gazetteerLocationType string = "APPROXIMATE"
+
+//Reverse lookups farther than this from every centroid find nothing
+const gazetteerReverseMaxMiles float64 = 25
+
+// gazetteerGeocoder resolves addresses offline to the centroid of their ZIP code,
+// or of their city when the ZIP code is unknown.
+type gazetteerGeocoder struct {
+	byZip  map[string]geocodeResult
+	byCity map[string][]geocodeResult
+}
+
+// loadGazetteer reads a CSV of zip,city,state,lat,lng rows. A header row is skipped.
+func loadGazetteer(path string) (geocoder, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	gazetteer := gazetteerGeocoder{byZip: make(map[string]geocodeResult), byCity: make(map[string][]geocodeResult)}
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = 5
+	reader.TrimLeadingSpace = true
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		lat, latErr := strconv.ParseFloat(record[3], 64)
+		lng, lngErr := strconv.ParseFloat(record[4], 64)
+		if latErr != nil || lngErr != nil {
+			if line == 1 {
+				continue
+			}
+			return nil, fmt.Errorf("%s:%d: invalid coordinates %q, %q", path, line, record[3], record[4])
+		}
+		result := geocodeResult{
+			FormattedAddress: fmt.Sprintf("%s, %s %s", record[1], record[2], record[0]),
+			Lat:              lat,
+			Lng:              lng,
+			LocationType:     gazetteerLocationType,
+			PlaceID:          "zip:" + record[0],
+			City:             record[1],
+			State:            record[2],
+			Zip:              record[0],
+		}
+		gazetteer.byZip[record[0]] = result
+		city := gazetteerCity(record[1])
+		gazetteer.byCity[city] = append(gazetteer.byCity[city], result)
+	}
+	return gazetteer, nil
+}
+
+func gazetteerCity(city string) string {
+	return strings.ToLower(strings.TrimSpace(city))
+}
+
+func (gazetteer gazetteerGeocoder) Name() string {
+	return "gazetteer"
+}
+
+func (gazetteer gazetteerGeocoder) Geocode(query geocodeQuery) ([]geocodeResult, error) {
+	if result, ok := gazetteer.byZip[strings.TrimSpace(query.Zip)]; ok {
+		return []geocodeResult{gazetteer.withStreet(result, query)}, nil
+	}
+
+	//Without a known ZIP code fall back to every centroid of the city, narrowed by state
+	results := make([]geocodeResult, 0)
+	for _, result := range gazetteer.byCity[gazetteerCity(query.City)] {
+		if len(query.State) == 0 || strings.EqualFold(result.State, strings.TrimSpace(query.State)) {
+			results = append(results, gazetteer.withStreet(result, query))
+		}
+	}
+	return results, nil
+}
+
+// ReverseGeocode finds the nearest ZIP code centroid.
+func (gazetteer gazetteerGeocoder) ReverseGeocode(lat float64, lng float64) ([]geocodeResult, error) {
+	var nearest geocodeResult
+	nearestMiles := gazetteerReverseMaxMiles
+	for _, result := range gazetteer.byZip {
+		if miles := haversineMiles(lat, lng, result.Lat, result.Lng); miles <= nearestMiles {
+			nearest, nearestMiles = result, miles
+		}
+	}
+	if len(nearest.Zip) == 0 {
+		return []geocodeResult{}, nil
+	}
+	nearest.Lat, nearest.Lng = lat, lng
+	return []geocodeResult{nearest}, nil
+}
+
+func (gazetteer gazetteerGeocoder) withStreet(result geocodeResult, query geocodeQuery) geocodeResult {
+	result.Address = query.Address
+	return result
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeGazetteer(t *testing.T, rows string) string {
+	dir, err := ioutil.TempDir("", "gazetteer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "zips.csv")
+	if err := ioutil.WriteFile(path, []byte(rows), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadGazetteer(t *testing.T) {
+	path := writeGazetteer(t, "zip,city,state,lat,lng\n"+
+		"94105, San Francisco, CA, 37.7898, -122.3942\n"+
+		"94107,San Francisco,CA,37.7621,-122.3971\n"+
+		"95112,San Jose,CA,37.3483,-121.8882\n"+
+		"97201,Portland,OR,45.5085,-122.6899\n"+
+		"04101,Portland,ME,43.6615,-70.2553\n")
+	defer os.RemoveAll(filepath.Dir(path))
+	loaded, err := loadGazetteer(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gazetteer := loaded.(gazetteerGeocoder)
+
+	tests := []struct {
+		name  string
+		query geocodeQuery
+		//want lists the ZIP codes of the results, in order when there are several
+		want []string
+	}{
+		{"zip", geocodeQuery{Address: "1 Market St", Zip: "94105"}, []string{"94105"}},
+		{"zip beats city", geocodeQuery{City: "Portland", Zip: " 95112 "}, []string{"95112"}},
+		{"city", geocodeQuery{City: "san jose"}, []string{"95112"}},
+		{"every centroid of a city", geocodeQuery{City: "San Francisco"}, []string{"94105", "94107"}},
+		{"city narrowed by state", geocodeQuery{City: "Portland", State: "me"}, []string{"04101"}},
+		{"unknown zip falls back to the city", geocodeQuery{City: "San Jose", Zip: "99999"}, []string{"95112"}},
+		{"unknown", geocodeQuery{City: "Springfield"}, nil},
+	}
+	for _, test := range tests {
+		results, err := gazetteer.Geocode(test.query)
+		if err != nil || len(results) != len(test.want) {
+			t.Errorf("%s: got %+v, %v, want %v", test.name, results, err, test.want)
+			continue
+		}
+		for i, result := range results {
+			if result.Zip != test.want[i] || result.Address != test.query.Address || result.PlaceID != "zip:"+test.want[i] || result.LocationType != gazetteerLocationType {
+				t.Errorf("%s: result %d is %+v, want ZIP code %s", test.name, i, result, test.want[i])
+			}
+		}
+	}
+	if result := gazetteer.byZip["94105"]; result.City != "San Francisco" || result.FormattedAddress != "San Francisco, CA 94105" {
+		t.Errorf("the leading spaces were kept in %+v", result)
+	}
+}
+
+func TestLoadGazetteerRejectsBadRows(t *testing.T) {
+	tests := []struct {
+		name string
+		rows string
+	}{
+		{"coordinates", "94105,San Francisco,CA,37.7898,-122.3942\n95112,San Jose,CA,north,-121.8882\n"},
+		{"columns", "94105,San Francisco,CA,37.7898\n"},
+	}
+	for _, test := range tests {
+		path := writeGazetteer(t, test.rows)
+		if _, err := loadGazetteer(path); err == nil {
+			t.Errorf("%s: a bad row loaded", test.name)
+		}
+		os.RemoveAll(filepath.Dir(path))
+	}
+	if _, err := loadGazetteer(filepath.Join(os.TempDir(), "no-such-gazetteer.csv")); err == nil {
+		t.Error("a missing file loaded")
+	}
+}
+
+func TestGazetteerReverseGeocode(t *testing.T) {
+	gazetteer := newTestGazetteer(testZips)
+	tests := []struct {
+		name     string
+		lat, lng float64
+		want     string
+	}{
+		{"at a centroid", testZips["95112"].Lat, testZips["95112"].Lng, "95112"},
+		{"nearest centroid", testZips["94301"].Lat + 0.01, testZips["94301"].Lng, "94301"},
+		{"too far from all", 40.7128, -74.0060, ""},
+	}
+	for _, test := range tests {
+		results, err := gazetteer.ReverseGeocode(test.lat, test.lng)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if len(test.want) == 0 {
+			if len(results) != 0 {
+				t.Errorf("%s: got %+v, want nothing", test.name, results)
+			}
+			continue
+		}
+		//The result keeps the coordinates looked up rather than the centroid's
+		if len(results) != 1 || results[0].Zip != test.want || results[0].Lat != test.lat || results[0].Lng != test.lng {
+			t.Errorf("%s: got %+v, want ZIP code %s", test.name, results, test.want)
+		}
+	}
+}
+
+func TestNominatimGeocoder(t *testing.T) {
+	var userAgents []string
+	var queries []map[string][]string
+	nominatimServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userAgents = append(userAgents, r.Header.Get("User-Agent"))
+		queries = append(queries, r.URL.Query())
+		switch {
+		case r.URL.Path == "/search":
+			w.Write([]byte(`[{"place_id": 1234, "lat": "37.3483", "lon": "-121.8882", "display_name": "1 Main St, San Jose", "type": "house",
+				"address": {"house_number": "1", "road": "Main St", "town": "San Jose", "state": "California", "postcode": "95112"}}]`))
+		case r.URL.Path == "/reverse" && r.URL.Query().Get("lat") == "0":
+			w.Write([]byte(`{"error": "Unable to geocode"}`))
+		case r.URL.Path == "/reverse":
+			w.Write([]byte(`{"place_id": 99, "lat": "37.7898", "lon": "-122.3942", "display_name": "San Francisco", "address": {"city": "San Francisco"}}`))
+		default:
+			http.Error(w, "slow down", http.StatusTooManyRequests)
+		}
+	}))
+	defer nominatimServer.Close()
+	nominatim := nominatimGeocoder{baseURL: nominatimServer.URL + "/", userAgent: "trip-planner-test", client: nominatimServer.Client()}
+
+	results, err := nominatim.Geocode(geocodeQuery{Address: "1 Main St", City: "San Jose", Zip: "95112"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := geocodeResult{FormattedAddress: "1 Main St, San Jose", Lat: 37.3483, Lng: -121.8882, LocationType: "house", PlaceID: "1234",
+		Address: "1 Main St", City: "San Jose", State: "California", Zip: "95112"}
+	if len(results) != 1 || results[0] != want {
+		t.Errorf("got %+v, want %+v", results, want)
+	}
+	//Blank fields are left out of the structured search
+	if query := queries[0]; query["street"][0] != "1 Main St" || query["postalcode"][0] != "95112" || query["state"] != nil {
+		t.Errorf("got query %v", query)
+	}
+
+	results, err = nominatim.ReverseGeocode(37.7898, -122.3942)
+	if err != nil || len(results) != 1 || results[0].City != "San Francisco" || results[0].PlaceID != "99" {
+		t.Errorf("got %+v, %v for a reverse lookup", results, err)
+	}
+	if results, err = nominatim.ReverseGeocode(0, 0); err != nil || len(results) != 0 {
+		t.Errorf("got %+v, %v for a reverse lookup of nothing", results, err)
+	}
+	for i, userAgent := range userAgents {
+		if userAgent != "trip-planner-test" {
+			t.Errorf("request %d was sent as %q", i, userAgent)
+		}
+	}
+
+	nominatim.baseURL = nominatimServer.URL + "/throttled"
+	if _, err := nominatim.Geocode(geocodeQuery{City: "San Jose"}); err == nil {
+		t.Error("a throttled search did not fail")
+	}
+}
+
+func TestNewGeocoder(t *testing.T) {
+	path := writeGazetteer(t, "94105,San Francisco,CA,37.7898,-122.3942\n")
+	defer os.RemoveAll(filepath.Dir(path))
+	tests := []struct {
+		provider string
+		want     string
+	}{
+		{"google", "google"},
+		{"nominatim", "nominatim"},
+		{"gazetteer", "gazetteer"},
+		{"bing", ""},
+	}
+	for _, test := range tests {
+		geocoder, err := newGeocoder(serverConfig{GeocoderProvider: test.provider, GazetteerCSV: path})
+		if len(test.want) == 0 {
+			if err == nil {
+				t.Errorf("%s: got no error", test.provider)
+			}
+			continue
+		}
+		if err != nil || geocoder.Name() != test.want {
+			t.Errorf("%s: got %v, %v", test.provider, geocoder, err)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"math"
+	"strings"
+)
+
+const geohashAlphabet string = "0123456789bcdefghjkmnpqrstuvwxyz"
+const maxGeohashPrecision int = 9
+
+// geohashEncode interleaves longitude and latitude bisections into a base32 string
+// of the given length. Locations that share a prefix lie in the same cell.
+func geohashEncode(lat float64, lng float64, precision int) string {
+	latRange := [2]float64{-90, 90}
+	lngRange := [2]float64{-180, 180}
+	var hash strings.Builder
+	bits, char := 0, 0
+	evenBit := true
+	for hash.Len() < precision {
+		if evenBit {
+			mid := (lngRange[0] + lngRange[1]) / 2
+			if lng >= mid {
+				char = char<<1 | 1
+				lngRange[0] = mid
+			} else {
+				char <<= 1
+				lngRange[1] = mid
+			}
+		} else {
+			mid := (latRange[0] + latRange[1]) / 2
+			if lat >= mid {
+				char = char<<1 | 1
+				latRange[0] = mid
+			} else {
+				char <<= 1
+				latRange[1] = mid
+			}
+		}
+		evenBit = !evenBit
+		if bits++; bits == 5 {
+			hash.WriteByte(geohashAlphabet[char])
+			bits, char = 0, 0
+		}
+	}
+	return hash.String()
+}
+
+// geohashCellSize is the height and width in degrees of a cell of the given precision.
+func geohashCellSize(precision int) (float64, float64) {
+	bits := 5 * precision
+	lngBits := (bits + 1) / 2
+	latBits := bits / 2
+	return 180 / math.Pow(2, float64(latBits)), 360 / math.Pow(2, float64(lngBits))
+}
+
+// geoBox is a latitude/longitude rectangle. West may be greater than East when the
+// box crosses the antimeridian.
+type geoBox struct {
+	South float64 `json:"south"`
+	West  float64 `json:"west"`
+	North float64 `json:"north"`
+	East  float64 `json:"east"`
+}
+
+func (box geoBox) contains(lat float64, lng float64) bool {
+	if lat < box.South || lat > box.North {
+		return false
+	}
+	if box.West <= box.East {
+		return lng >= box.West && lng <= box.East
+	}
+	return lng >= box.West || lng <= box.East
+}
+
+func (box geoBox) center() (float64, float64) {
+	east := box.East
+	if box.West > east {
+		east += 360
+	}
+	lng := (box.West + east) / 2
+	if lng > 180 {
+		lng -= 360
+	}
+	return (box.South + box.North) / 2, lng
+}
+
+// circleBox is the smallest box around a circle of radiusMiles.
+func circleBox(lat float64, lng float64, radiusMiles float64) geoBox {
+	milesPerDegree := earthRadiusMiles * math.Pi / 180
+	dLat := radiusMiles / milesPerDegree
+	box := geoBox{South: math.Max(lat-dLat, -90), North: math.Min(lat+dLat, 90), West: -180, East: 180}
+	//Near the poles every longitude is within reach
+	if cos := math.Cos(math.Max(math.Abs(box.South), math.Abs(box.North)) * math.Pi / 180); cos > 1e-9 {
+		if dLng := dLat / cos; dLng < 180 {
+			box.West = normalizeLng(lng - dLng)
+			box.East = normalizeLng(lng + dLng)
+		}
+	}
+	return box
+}
+
+func normalizeLng(lng float64) float64 {
+	for lng < -180 {
+		lng += 360
+	}
+	for lng > 180 {
+		lng -= 360
+	}
+	return lng
+}
+
+// coveringGeohashes returns geohash prefixes whose cells together cover the box,
+// using the finest precision that needs at most maxCells cells.
+func coveringGeohashes(box geoBox, maxCells int) []string {
+	if box.West > box.East {
+		west := coveringGeohashes(geoBox{South: box.South, West: box.West, North: box.North, East: 180}, maxCells/2)
+		return append(west, coveringGeohashes(geoBox{South: box.South, West: -180, North: box.North, East: box.East}, maxCells/2)...)
+	}
+
+	precision := 1
+	for p := maxGeohashPrecision; p >= 1; p-- {
+		cellLat, cellLng := geohashCellSize(p)
+		cells := (math.Floor((box.North-box.South)/cellLat) + 2) * (math.Floor((box.East-box.West)/cellLng) + 2)
+		if cells <= float64(maxCells) {
+			precision = p
+			break
+		}
+	}
+
+	cellLat, cellLng := geohashCellSize(precision)
+	seen := make(map[string]bool)
+	hashes := make([]string, 0)
+	for lat := box.South; ; lat += cellLat {
+		lat = math.Min(lat, box.North)
+		for lng := box.West; ; lng += cellLng {
+			lng = math.Min(lng, box.East)
+			if hash := geohashEncode(lat, lng, precision); !seen[hash] {
+				seen[hash] = true
+				hashes = append(hashes, hash)
+			}
+			if lng >= box.East {
+				break
+			}
+		}
+		if lat >= box.North {
+			break
+		}
+	}
+	return hashes
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestGeohashEncode(t *testing.T) {
+	tests := []struct {
+		lat, lng  float64
+		precision int
+		want      string
+	}{
+		{57.64911, 10.40744, 9, "u4pruydqq"},
+		{57.64911, 10.40744, 3, "u4p"},
+		{37.7749, -122.4194, 5, "9q8yy"},
+		{-33.8688, 151.2093, 6, "r3gx2f"},
+		{0, 0, 1, "s"},
+		{-90, -180, 2, "00"},
+	}
+	for _, test := range tests {
+		if got := geohashEncode(test.lat, test.lng, test.precision); got != test.want {
+			t.Errorf("geohashEncode(%v, %v, %d) = %q, want %q", test.lat, test.lng, test.precision, got, test.want)
+		}
+	}
+
+	//Five characters are 13 longitude and 12 latitude bisections
+	cellLat, cellLng := geohashCellSize(5)
+	if cellLat != 180.0/4096 || cellLng != 360.0/8192 {
+		t.Errorf("a cell of precision 5 is %v by %v degrees", cellLat, cellLng)
+	}
+}
+
+func TestGeoBox(t *testing.T) {
+	box := geoBox{South: -10, West: 170, North: 10, East: -170}
+	tests := []struct {
+		lat, lng float64
+		want     bool
+	}{
+		{0, 180, true},
+		{0, 175, true},
+		{0, -175, true},
+		{0, 0, false},
+		{11, 175, false},
+	}
+	for _, test := range tests {
+		if got := box.contains(test.lat, test.lng); got != test.want {
+			t.Errorf("contains(%v, %v) = %v across the antimeridian", test.lat, test.lng, got)
+		}
+	}
+	if lat, lng := box.center(); lat != 0 || math.Abs(lng) != 180 {
+		t.Errorf("the center across the antimeridian is %v, %v", lat, lng)
+	}
+	if lat, lng := (geoBox{South: 30, West: -120, North: 40, East: -110}).center(); lat != 35 || lng != -115 {
+		t.Errorf("the center is %v, %v", lat, lng)
+	}
+}
+
+func TestCircleBox(t *testing.T) {
+	r := rand.New(rand.NewSource(7))
+	for trial := 0; trial < 200; trial++ {
+		lat, lng := r.Float64()*170-85, r.Float64()*360-180
+		radius := r.Float64() * 300
+		box := circleBox(lat, lng, radius)
+		//Every point on the circle is inside the box
+		for bearing := 0.0; bearing < 2*math.Pi; bearing += math.Pi / 8 {
+			pointLat, pointLng := destination(lat, lng, radius*0.999, bearing)
+			if !box.contains(pointLat, pointLng) {
+				t.Fatalf("the box %+v around %v, %v misses %v, %v at %v miles", box, lat, lng, pointLat, pointLng, radius)
+			}
+		}
+	}
+	if box := circleBox(89.9, 0, 50); box.West != -180 || box.East != 180 || box.North != 90 {
+		t.Errorf("the box around the pole is %+v", box)
+	}
+}
+
+// destination is the point reached from lat/lng after miles along bearing, in radians from north.
+func destination(lat float64, lng float64, miles float64, bearing float64) (float64, float64) {
+	toRadians := math.Pi / 180
+	angle := miles / earthRadiusMiles
+	lat1, lng1 := lat*toRadians, lng*toRadians
+	lat2 := math.Asin(math.Sin(lat1)*math.Cos(angle) + math.Cos(lat1)*math.Sin(angle)*math.Cos(bearing))
+	lng2 := lng1 + math.Atan2(math.Sin(bearing)*math.Sin(angle)*math.Cos(lat1), math.Cos(angle)-math.Sin(lat1)*math.Sin(lat2))
+	return lat2 / toRadians, normalizeLng(lng2 / toRadians)
+}
+
+func TestCoveringGeohashesCoverTheBox(t *testing.T) {
+	r := rand.New(rand.NewSource(11))
+	for trial := 0; trial < 200; trial++ {
+		south := r.Float64()*160 - 80
+		box := geoBox{South: south, North: math.Min(south+r.Float64()*r.Float64()*20, 90), West: r.Float64()*360 - 180}
+		box.East = normalizeLng(box.West + r.Float64()*r.Float64()*40)
+		hashes := coveringGeohashes(box, 32)
+		if len(hashes) > 32 {
+			t.Fatalf("%+v is covered by %d cells, want at most 32", box, len(hashes))
+		}
+		for point := 0; point < 50; point++ {
+			lat := box.South + r.Float64()*(box.North-box.South)
+			east := box.East
+			if box.West > east {
+				east += 360
+			}
+			lng := normalizeLng(box.West + r.Float64()*(east-box.West))
+			hash := geohashEncode(lat, lng, maxGeohashPrecision)
+			covered := false
+			for _, prefix := range hashes {
+				covered = covered || strings.HasPrefix(hash, prefix)
+			}
+			if !covered {
+				t.Fatalf("%v, %v inside %+v is in none of %v", lat, lng, box, hashes)
+			}
+		}
+	}
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+const maxImportBytes int64 = 10 << 20
+
+// importCommandActor is the actor recorded for locations created by the import command.
+const importCommandActor string = "import-command"
+
+const importStatusCreated string = "created"
+const importStatusDuplicate string = "duplicate"
+const importStatusGeocodeFailed string = "geocode_failed"
+const importStatusInvalid string = "invalid"
+const importStatusStoreFailed string = "store_failed"
+
+// importRow is one location read from an import file. Row counts data rows and
+// features from 1, not counting a CSV header.
+type importRow struct {
+	Row           int
+	Location      locationStruct
+	HasCoordinate bool
+	Err           error
+}
+
+type importRowResult struct {
+	Row         int    `json:"row"`
+	Name        string `json:"name"`
+	Status      string `json:"status"`
+	ID          string `json:"id,omitempty"`
+	DuplicateOf string `json:"duplicate_of,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+type importReport struct {
+	Created    int               `json:"created"`
+	Duplicates int               `json:"duplicates"`
+	Failed     int               `json:"failed"`
+	Rows       []importRowResult `json:"rows"`
+}
+
+// importColumns are the CSV columns in the order used when a file has no header.
+var importColumns = []string{"name", "address", "city", "state", "zip", "lat", "lng", "tags", "category", "notes", "owner"}
+
+// importTagSeparator separates the tags of a location within their CSV column.
+const importTagSeparator string = ";"
+
+// parseImportCSV reads name,address,city,state,zip[,lat,lng,tags,category,notes,owner]
+// rows. A first row starting with "name" is a header, and then columns may come in
+// any order.
+func parseImportCSV(input io.Reader) ([]importRow, error) {
+	reader := csv.NewReader(input)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, badRequest("invalid_csv", err.Error(), nil)
+	}
+
+	columns := make(map[string]int)
+	for i, name := range importColumns {
+		columns[name] = i
+	}
+	if len(records) > 0 && strings.EqualFold(strings.TrimSpace(records[0][0]), "name") {
+		columns = make(map[string]int)
+		for i, name := range records[0] {
+			columns[strings.ToLower(strings.TrimSpace(name))] = i
+		}
+		records = records[1:]
+	}
+	field := func(record []string, name string) string {
+		if i, ok := columns[name]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+
+	rows := make([]importRow, len(records))
+	for i, record := range records {
+		row := importRow{Row: i + 1}
+		row.Location.Name = field(record, "name")
+		row.Location.Address = field(record, "address")
+		row.Location.City = field(record, "city")
+		row.Location.State = field(record, "state")
+		row.Location.Zip = field(record, "zip")
+		if tags := field(record, "tags"); len(tags) > 0 {
+			row.Location.Tags = strings.Split(tags, importTagSeparator)
+		}
+		row.Location.Category = field(record, "category")
+		row.Location.Notes = field(record, "notes")
+		row.Location.Owner = field(record, "owner")
+		normalizeLocation(&row.Location)
+
+		lat, lng := field(record, "lat"), field(record, "lng")
+		if len(lat) > 0 || len(lng) > 0 {
+			row.Location.Coordinate.Lat, row.Location.Coordinate.Lng, row.Err = parseImportCoordinate(lat, lng)
+			row.HasCoordinate = row.Err == nil
+		}
+		rows[i] = row
+	}
+	return rows, nil
+}
+
+func parseImportCoordinate(rawLat string, rawLng string) (float64, float64, error) {
+	lat, err := strconv.ParseFloat(rawLat, 64)
+	if err != nil || lat < -90 || lat > 90 {
+		return 0, 0, fmt.Errorf("invalid latitude %q", rawLat)
+	}
+	lng, err := strconv.ParseFloat(rawLng, 64)
+	if err != nil || lng < -180 || lng > 180 {
+		return 0, 0, fmt.Errorf("invalid longitude %q", rawLng)
+	}
+	return lat, lng, nil
+}
+
+type geoJSONFeatureCollection struct {
+	Type     string           `json:"type"`
+	Features []geoJSONFeature `json:"features"`
+}
+
+type geoJSONFeature struct {
+	Type     string `json:"type"`
+	Geometry *struct {
+		Type        string    `json:"type"`
+		Coordinates []float64 `json:"coordinates"`
+	} `json:"geometry"`
+	Properties struct {
+		ID       string   `json:"id,omitempty"`
+		Name     string   `json:"name"`
+		Address  string   `json:"address"`
+		City     string   `json:"city"`
+		State    string   `json:"state"`
+		Zip      string   `json:"zip"`
+		Tags     []string `json:"tags,omitempty"`
+		Category string   `json:"category,omitempty"`
+		Notes    string   `json:"notes,omitempty"`
+		Owner    string   `json:"owner,omitempty"`
+	} `json:"properties"`
+}
+
+// parseImportGeoJSON reads the features of a FeatureCollection. Features without a
+// Point geometry are geocoded from their properties.
+func parseImportGeoJSON(input io.Reader) ([]importRow, error) {
+	var collection geoJSONFeatureCollection
+	err := json.NewDecoder(input).Decode(&collection)
+	if err != nil {
+		return nil, badRequest("invalid_geojson", err.Error(), nil)
+	}
+	if collection.Type != "FeatureCollection" {
+		return nil, badRequest("invalid_geojson", "expected a FeatureCollection", map[string]string{"type": collection.Type})
+	}
+
+	rows := make([]importRow, len(collection.Features))
+	for i, feature := range collection.Features {
+		row := importRow{Row: i + 1}
+		row.Location.Name = feature.Properties.Name
+		row.Location.Address = feature.Properties.Address
+		row.Location.City = feature.Properties.City
+		row.Location.State = feature.Properties.State
+		row.Location.Zip = feature.Properties.Zip
+		row.Location.Tags = feature.Properties.Tags
+		row.Location.Category = feature.Properties.Category
+		row.Location.Notes = feature.Properties.Notes
+		row.Location.Owner = feature.Properties.Owner
+		normalizeLocation(&row.Location)
+		if geometry := feature.Geometry; geometry != nil {
+			if geometry.Type != "Point" || len(geometry.Coordinates) < 2 {
+				row.Err = fmt.Errorf("unsupported geometry %q, only Point is imported", geometry.Type)
+			} else {
+				//GeoJSON positions are longitude first
+				row.Location.Coordinate.Lat, row.Location.Coordinate.Lng, row.Err = parseImportCoordinate(
+					strconv.FormatFloat(geometry.Coordinates[1], 'f', -1, 64), strconv.FormatFloat(geometry.Coordinates[0], 'f', -1, 64))
+				row.HasCoordinate = row.Err == nil
+			}
+		}
+		rows[i] = row
+	}
+	return rows, nil
+}
+
+// locationKey identifies duplicate locations by their name and address, ignoring case and spacing.
+func locationKey(location locationStruct) string {
+	parts := []string{location.Name, location.Address, location.City, location.State, location.Zip}
+	for i, part := range parts {
+		parts[i] = strings.ToLower(strings.Join(strings.Fields(part), " "))
+	}
+	return strings.Join(parts, "|")
+}
+
+// findDuplicateLocation returns the ID of a saved location with the same name and address, if any.
+func findDuplicateLocation(location locationStruct) (string, error) {
+	var duplicateOf string
+	query := locationQuery{Name: location.Name, City: location.City, State: location.State, Zip: location.Zip, SortField: "id"}
+	err := forEachLocation(query, func(saved locationStruct) bool {
+		if locationKey(saved) == locationKey(location) {
+			duplicateOf = saved.ID.Hex()
+		}
+		return len(duplicateOf) == 0
+	})
+	return duplicateOf, err
+}
+
+// importLocations saves the rows that are valid, geocoded and not yet known, and
+// reports the outcome of every row. Only store failures abort the import, and then
+// the report covers the rows up to the failing one, which is saved as store_failed.
+// The created locations are recorded in their history as made by actor.
+func importLocations(rows []importRow, actor string) (importReport, error) {
+	report := importReport{Rows: make([]importRowResult, 0, len(rows))}
+	imported := make(map[string]string)
+	for _, row := range rows {
+		result, err := importLocationRow(row, imported, actor)
+		if err != nil {
+			result.Status, result.Error = importStatusStoreFailed, err.Error()
+			report.Failed++
+			report.Rows = append(report.Rows, result)
+			return report, err
+		}
+		switch result.Status {
+		case importStatusCreated:
+			report.Created++
+		case importStatusDuplicate:
+			report.Duplicates++
+		default:
+			report.Failed++
+		}
+		report.Rows = append(report.Rows, result)
+	}
+	return report, nil
+}
+
+// importLocationRow saves a single row. imported maps the locationKey of the rows
+// created so far in this import to their IDs.
+func importLocationRow(row importRow, imported map[string]string, actor string) (importRowResult, error) {
+	result := importRowResult{Row: row.Row, Name: row.Location.Name}
+	location := row.Location
+	if row.Err != nil {
+		result.Status, result.Error = importStatusInvalid, row.Err.Error()
+		return result, nil
+	}
+	if len(strings.TrimSpace(location.Name)) == 0 {
+		result.Status, result.Error = importStatusInvalid, "name is required"
+		return result, nil
+	}
+
+	key := locationKey(location)
+	duplicateOf, err := findDuplicateLocation(location)
+	if err != nil {
+		return result, err
+	}
+	if len(duplicateOf) == 0 {
+		duplicateOf = imported[key]
+	}
+	if len(duplicateOf) > 0 {
+		result.Status, result.DuplicateOf = importStatusDuplicate, duplicateOf
+		return result, nil
+	}
+
+	if !row.HasCoordinate {
+		err = geocodeLocation(&location)
+		if err != nil {
+			result.Status, result.Error = importStatusGeocodeFailed, toAPIError(err).Message
+			return result, nil
+		}
+	}
+	location.ID = bson.NewObjectId()
+	location.Version = 1
+	err = store.InsertLocation(location)
+	if err != nil {
+		return result, err
+	}
+	recordLocationChange(actor, auditActionCreate, nil, &location, !row.HasCoordinate)
+	imported[key] = location.ID.Hex()
+	result.Status, result.ID = importStatusCreated, location.ID.Hex()
+	return result, nil
+}
+
+// parseImport reads an import file in the given format, "csv" or "geojson".
+func parseImport(format string, input io.Reader) ([]importRow, error) {
+	switch format {
+	case "csv":
+		return parseImportCSV(input)
+	case "geojson":
+		return parseImportGeoJSON(input)
+	}
+	return nil, badRequest("invalid_format", "format must be csv or geojson", map[string]string{"format": format})
+}
+
+// importFormat takes the format from the format parameter or else from the content type.
+func importFormat(r *http.Request) string {
+	if format := r.URL.Query().Get("format"); len(format) > 0 {
+		return strings.ToLower(format)
+	}
+	contentType := r.Header.Get("Content-Type")
+	if strings.Contains(contentType, "csv") {
+		return "csv"
+	}
+	if strings.Contains(contentType, "json") {
+		return "geojson"
+	}
+	return contentType
+}
+
+// bulkImportLocations serves POST /locations/import with a CSV or GeoJSON body.
+func bulkImportLocations(w http.ResponseWriter, r *http.Request) {
+	rows, err := parseImport(importFormat(r), http.MaxBytesReader(w, r.Body, maxImportBytes))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	report, err := importLocations(rows, requestActor(r))
+	if err != nil {
+		//Tell the client which rows were created before the store failed
+		apiErr := toAPIError(err)
+		writeError(w, newAPIError(apiErr.Status, apiErr.Code, apiErr.Message, report))
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+// runImportCommand implements "import [csv|geojson] <file>", importing into the
+// configured store and printing the report as JSON, also when the store fails.
+func runImportCommand(args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return fmt.Errorf("usage: import [csv|geojson] <file>")
+	}
+	path := args[len(args)-1]
+	format := "csv"
+	if strings.HasSuffix(strings.ToLower(path), "json") {
+		format = "geojson"
+	}
+	if len(args) == 2 {
+		format = args[0]
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	rows, err := parseImport(format, file)
+	if err != nil {
+		return err
+	}
+	report, importErr := importLocations(rows, importCommandActor)
+	outputJSON, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(outputJSON))
+	return importErr
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseImportCSV(t *testing.T) {
+	input := "Office,1 Market St,San Francisco,CA,94105,37.7898,-122.3942,Work;HQ\n" +
+		"Lab,3 University Ave,Palo Alto,CA,94301,north,-122.1\n" +
+		"Client,9 Market St,San Jose,CA,95112\n"
+	rows, err := parseImportCSV(strings.NewReader(input))
+	if err != nil || len(rows) != 3 {
+		t.Fatalf("got %+v, %v", rows, err)
+	}
+	office := rows[0]
+	if office.Row != 1 || !office.HasCoordinate || office.Location.Coordinate.Lat != 37.7898 || strings.Join(office.Location.Tags, ",") != "hq,work" {
+		t.Errorf("got %+v", office)
+	}
+	if rows[1].Err == nil || rows[1].HasCoordinate {
+		t.Errorf("an invalid latitude was read as %+v", rows[1])
+	}
+	if rows[2].Err != nil || rows[2].HasCoordinate || rows[2].Location.Zip != "95112" {
+		t.Errorf("a row to geocode was read as %+v", rows[2])
+	}
+
+	//A header, which starts with name, orders the other columns
+	rows, _ = parseImportCSV(strings.NewReader("Name, owner, zip\nOffice, ops, 94105\n"))
+	if len(rows) != 1 || rows[0].Row != 1 || rows[0].Location.Name != "Office" || rows[0].Location.Zip != "94105" || rows[0].Location.Owner != "ops" {
+		t.Errorf("got %+v", rows)
+	}
+	if _, err := parseImportCSV(strings.NewReader("Office,\"1 Market St\n")); toAPIError(err).Code != "invalid_csv" {
+		t.Errorf("a broken quote returned %v", err)
+	}
+}
+
+func TestParseImportGeoJSON(t *testing.T) {
+	input := `{"type":"FeatureCollection","features":[
+		{"type":"Feature","geometry":{"type":"Point","coordinates":[-122.3942,37.7898]},"properties":{"name":"Office","tags":["Work"]}},
+		{"type":"Feature","geometry":{"type":"LineString","coordinates":[]},"properties":{"name":"Road"}},
+		{"type":"Feature","geometry":null,"properties":{"name":"Client","zip":"95112"}}]}`
+	rows, err := parseImportGeoJSON(strings.NewReader(input))
+	if err != nil || len(rows) != 3 {
+		t.Fatalf("got %+v, %v", rows, err)
+	}
+	office := rows[0].Location
+	if !rows[0].HasCoordinate || office.Coordinate.Lat != 37.7898 || office.Coordinate.Lng != -122.3942 || office.Tags[0] != "work" {
+		t.Errorf("got %+v", rows[0])
+	}
+	if rows[1].Err == nil || rows[2].Err != nil || rows[2].HasCoordinate {
+		t.Errorf("got %+v and %+v", rows[1], rows[2])
+	}
+	if _, err := parseImportGeoJSON(strings.NewReader(`{"type":"Feature"}`)); toAPIError(err).Code != "invalid_geojson" {
+		t.Errorf("a single feature returned %v", err)
+	}
+}
+
+func TestImportLocations(t *testing.T) {
+	server, stop := newTestServer(t)
+	defer stop()
+	existing := addTestLocation(t, server, "Office", "94105")
+	input := "name,address,zip\n" +
+		"Office,1 Main St,94105\n" +
+		"Client,9 Market St,95112\n" +
+		"client, 9  market st ,95112\n" +
+		",1 Elm St,94301\n" +
+		"Cabin,1 Lake Rd,96145\n"
+	rows, _ := parseImportCSV(strings.NewReader(input))
+
+	report, err := importLocations(rows, "tester")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Created != 1 || report.Duplicates != 2 || report.Failed != 2 || len(report.Rows) != 5 {
+		t.Fatalf("got %+v", report)
+	}
+	want := []string{importStatusDuplicate, importStatusCreated, importStatusDuplicate, importStatusInvalid, importStatusGeocodeFailed}
+	for i, result := range report.Rows {
+		if result.Status != want[i] || result.Row != i+1 {
+			t.Errorf("row %d got %+v, want %s", i+1, result, want[i])
+		}
+	}
+	//Duplicates are found among the saved locations and the rows imported before
+	if report.Rows[0].DuplicateOf != existing || report.Rows[2].DuplicateOf != report.Rows[1].ID {
+		t.Errorf("got %+v", report.Rows)
+	}
+	client, err := store.FindLocation(report.Rows[1].ID)
+	if err != nil || client.Version != 1 || client.Coordinate.Lat != testZips["95112"].Lat {
+		t.Errorf("the imported location was saved as %+v, %v", client, err)
+	}
+	if history, _ := store.LocationHistory(client.ID.Hex()); len(history) != 1 || history[0].Actor != "tester" {
+		t.Errorf("the import was recorded as %+v", history)
+	}
+}
+
+func TestImportRoundTripsTheExport(t *testing.T) {
+	server, stop := newTestServer(t)
+	defer stop()
+	locations := exportedLocations()
+	var exported bytes.Buffer
+	if err := writeCSV(&exported, locations); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := parseImportCSV(bytes.NewReader(exported.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	//The exported coordinates are kept, so nothing is geocoded
+	locationGeocoder = &stubGeocoder{err: errors.New("offline")}
+	if report, err := importLocations(rows, "tester"); err != nil || report.Created != 2 {
+		t.Fatalf("got %+v, %v", report, err)
+	}
+	rows, _ = parseImportCSV(bytes.NewReader(exported.Bytes()))
+	if report, _ := importLocations(rows, "tester"); report.Duplicates != 2 {
+		t.Errorf("importing the export again got %+v", report)
+	}
+
+	var page locationPage
+	sendJSON(t, server, "GET", "/locations/?sort=name", nil, &page)
+	if len(page.Locations) != 2 {
+		t.Fatalf("got %+v", page.Locations)
+	}
+	office, imported := locations[0], page.Locations[0]
+	if imported.Name != office.Name || imported.Address != office.Address || imported.City != office.City || imported.Coordinate != office.Coordinate ||
+		strings.Join(imported.Tags, ";") != "hq;work" || imported.Category != office.Category || imported.Notes != office.Notes || imported.Owner != office.Owner {
+		t.Errorf("imported %+v from %+v", imported, office)
+	}
+}
+
+// failingInsertStore fails to insert locations after the first allowed ones.
+type failingInsertStore struct {
+	*memoryStore
+	allowed int
+}
+
+func (failing *failingInsertStore) InsertLocation(location locationStruct) error {
+	if failing.allowed == 0 {
+		return errors.New("connection reset")
+	}
+	failing.allowed--
+	return failing.memoryStore.InsertLocation(location)
+}
+
+const failingImportCSV string = "Office,1 Main St,,,94105\nInvalid,1 Main St,,,94105,north,0\nClient,1 Main St,,,95112\nLab,1 Main St,,,94301\n"
+
+func TestImportLocationsReportsStoreFailures(t *testing.T) {
+	server, stop := newTestServer(t)
+	defer stop()
+	memory := store.(*memoryStore)
+	store = &failingInsertStore{memoryStore: memory, allowed: 1}
+
+	var failed struct {
+		Code    string       `json:"code"`
+		Details importReport `json:"details"`
+	}
+	request, _ := http.NewRequest("POST", server.URL+"/locations/import", strings.NewReader(failingImportCSV))
+	request.Header.Set("Content-Type", "text/csv")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	decodeErr := json.NewDecoder(response.Body).Decode(&failed)
+	if response.StatusCode != http.StatusInternalServerError || decodeErr != nil {
+		t.Fatalf("got %d, %v", response.StatusCode, decodeErr)
+	}
+	//The report stops at the failing row, after the office was created
+	report := failed.Details
+	if report.Created != 1 || report.Failed != 2 || len(report.Rows) != 3 || report.Rows[2].Status != importStatusStoreFailed || report.Rows[2].Name != "Client" || len(report.Rows[2].Error) == 0 {
+		t.Errorf("got report %+v", report)
+	}
+	if _, err := memory.FindLocation(report.Rows[0].ID); err != nil {
+		t.Errorf("the created location is missing, %v", err)
+	}
+}
+
+func TestRunImportCommandPrintsPartialReports(t *testing.T) {
+	_, stop := newTestServer(t)
+	defer stop()
+	store = &failingInsertStore{memoryStore: store.(*memoryStore), allowed: 1}
+	dir, err := ioutil.TempDir("", "import")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "locations.csv")
+	if err := ioutil.WriteFile(path, []byte(failingImportCSV), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	stdout := os.Stdout
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Stdout = writer
+	err = runImportCommand([]string{path})
+	os.Stdout = stdout
+	writer.Close()
+	printed, _ := ioutil.ReadAll(reader)
+
+	if err == nil || !strings.Contains(err.Error(), "connection reset") {
+		t.Errorf("got error %v", err)
+	}
+	if !strings.Contains(string(printed), `"created": 1`) || !strings.Contains(string(printed), importStatusStoreFailed) {
+		t.Errorf("printed %s", printed)
+	}
+	if err := runImportCommand([]string{"csv", "geojson", path}); err == nil {
+		t.Error("three arguments were accepted")
+	}
+}
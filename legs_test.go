@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// legsMatrix joins three locations by legs whose estimate encodes the pair, so the
+// leg from i to j costs 10*i+j.
+func legsMatrix(end int) costMatrix {
+	matrix := costMatrix{locations: make([]locationStruct, 3), legs: make([][]legEstimate, 3), end: end}
+	for i := range matrix.locations {
+		matrix.locations[i].ID = bson.NewObjectId()
+		matrix.legs[i] = make([]legEstimate, 3)
+		for j := range matrix.legs[i] {
+			pair := float64(10*i + j)
+			matrix.legs[i][j] = legEstimate{LowEstimate: pair, HighEstimate: pair + 1, Currency: "USD", ProductID: "uberX", SurgeMultiplier: 1.5, Distance: pair, Duration: 60 * (10*i + j)}
+		}
+	}
+	return matrix
+}
+
+func TestRouteLegs(t *testing.T) {
+	tests := []struct {
+		name      string
+		end       int
+		route     []int
+		wantPairs []int
+	}{
+		{"round trip", 0, []int{2, 1}, []int{2, 21, 10}},
+		{"open route", noRouteEnd, []int{1, 2}, []int{1, 12}},
+		{"fixed destination", 2, []int{1}, []int{1, 12}},
+		{"no stops", noRouteEnd, []int{}, []int{}},
+	}
+	for _, test := range tests {
+		matrix := legsMatrix(test.end)
+		legs := matrix.routeLegs(test.route)
+		if len(legs) != len(test.wantPairs) {
+			t.Errorf("%s: got %d legs, want %d", test.name, len(legs), len(test.wantPairs))
+			continue
+		}
+		from := matrix.locations[0].ID.Hex()
+		for i, leg := range legs {
+			pair := test.wantPairs[i]
+			to := matrix.locations[pair%10].ID.Hex()
+			if leg.FromLocationID != from || leg.ToLocationID != to || leg.LowEstimate != float64(pair) || leg.HighEstimate != float64(pair+1) || leg.Duration != 60*pair ||
+				leg.CurrencyCode != "USD" || leg.ProductID != "uberX" || leg.SurgeMultiplier != 1.5 {
+				t.Errorf("%s: leg %d is %+v, want the leg %02d", test.name, i, leg, pair)
+			}
+			from = to
+		}
+	}
+}
+
+func TestUberPriceEstimator(t *testing.T) {
+	var query string
+	uber := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.RawQuery
+		if r.URL.Query().Get("server_token") != "secret" {
+			http.Error(w, `{"message":"Invalid OAuth 2.0 credentials provided."}`, http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, `{"prices":[
+			{"product_id":"pool","display_name":"POOL","currency_code":"USD","low_estimate":8,"high_estimate":10,"estimate":"$8-10","duration":900,"distance":5.2,"surge_multiplier":1},
+			{"product_id":"x","display_name":"uberX","currency_code":"USD","low_estimate":12,"high_estimate":16,"minimum":7,"estimate":"$12-16","duration":840,"distance":5.2,"surge_multiplier":1.25}]}`)
+	}))
+	defer uber.Close()
+	requestURL := strings.Replace(uberRequestURL, "https://api.uber.com", uber.URL, 1)
+	estimator := uberPriceEstimator{requestURL: requestURL, serverToken: "secret", client: uber.Client()}
+	sanFrancisco, sanJose := locationStruct{Name: "Office"}, locationStruct{Name: "Client"}
+	sanFrancisco.Coordinate.Lat, sanFrancisco.Coordinate.Lng = testZips["94105"].Lat, testZips["94105"].Lng
+	sanJose.Coordinate.Lat, sanJose.Coordinate.Lng = testZips["95112"].Lat, testZips["95112"].Lng
+
+	leg, err := estimator.Estimate(sanFrancisco, sanJose, "uberX")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leg.ProductID != "x" || leg.LowEstimate != 12 || leg.HighEstimate != 16 || leg.Minimum != 7 || leg.Estimate != "$12-16" || leg.Currency != "USD" ||
+		leg.SurgeMultiplier != 1.25 || leg.Cost != 1200 || leg.Duration != 840 || leg.Distance != 5.2 {
+		t.Errorf("got %+v", leg)
+	}
+	if !strings.Contains(query, "start_latitude=37.789") || !strings.Contains(query, "end_longitude=-121.8838") {
+		t.Errorf("the coordinates were sent as %s", query)
+	}
+	if leg, err = estimator.Estimate(sanFrancisco, sanJose, ""); err != nil || leg.ProductID != "pool" {
+		t.Errorf("the first product is %+v, %v", leg, err)
+	}
+	if _, err = estimator.Estimate(sanFrancisco, sanJose, "uberBLACK"); err == nil {
+		t.Error("an unknown product was priced")
+	}
+	estimator.serverToken = "expired"
+	if _, err = estimator.Estimate(sanFrancisco, sanJose, ""); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("a refused estimate returned %v", err)
+	}
+}
+
+func TestGetTripReturnsLegs(t *testing.T) {
+	server, stop := newTestServer(t)
+	defer stop()
+	tripID, _ := addTestTrip(t, server)
+
+	var trip UberResponse
+	if status := sendJSON(t, server, "GET", "/trips/"+tripID, nil, &trip); status != http.StatusOK || len(trip.Legs) != 2 {
+		t.Fatalf("got %d with legs %+v", status, trip.Legs)
+	}
+	out, back := trip.Legs[0], trip.Legs[1]
+	if out.FromLocationID != trip.StartingFromLocationID || out.ToLocationID != trip.BestRouteLocationIds[0] || back.FromLocationID != out.ToLocationID || back.ToLocationID != trip.StartingFromLocationID {
+		t.Errorf("the legs go %s -> %s and %s -> %s", out.FromLocationID, out.ToLocationID, back.FromLocationID, back.ToLocationID)
+	}
+	//The offline estimates are symmetric, so both legs cost the same
+	if out.LowEstimate <= 0 || out.LowEstimate != back.LowEstimate || out.HighEstimate < out.LowEstimate || len(out.Estimate) == 0 || out.SurgeMultiplier != 1 || out.Distance <= 0 {
+		t.Errorf("got legs %+v", trip.Legs)
+	}
+	if trip.TotalUberDuration != out.Duration+back.Duration || trip.TotalDistance != out.Distance+back.Distance {
+		t.Errorf("the totals %ds and %v miles do not add up the legs", trip.TotalUberDuration, trip.TotalDistance)
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+const defaultPageSize int = 20
+const maxPageSize int = 100
+
+// locationSortFields are the fields locations can be listed by, besides their ID.
+var locationSortFields = map[string]bool{"id": true, "name": true, "city": true, "state": true, "zip": true}
+
+// locationQuery selects and orders saved locations. Name, City, State, Zip, Category
+// and Owner match whole values ignoring case, Search matches part of the name or
+// address and a location must carry all of the Tags.
+type locationQuery struct {
+	Name       string
+	City       string
+	State      string
+	Zip        string
+	Category   string
+	Owner      string
+	Tags       []string
+	Search     string
+	SortField  string
+	Descending bool
+	Limit      int
+	//Position after which the page starts, nil for the first page
+	After *locationCursor
+}
+
+// locationCursor is the sort value and ID of the last location of a page. Pages are
+// ordered by the sort field and then by ID, so the pair is unique.
+type locationCursor struct {
+	Sort  string        `json:"sort"`
+	Value string        `json:"value"`
+	ID    bson.ObjectId `json:"id"`
+}
+
+type locationPage struct {
+	Locations  []locationStruct `json:"locations"`
+	NextCursor string           `json:"next_cursor,omitempty"`
+}
+
+func (cursor locationCursor) encode() string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeLocationCursor(encoded string) (*locationCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	var cursor locationCursor
+	err = json.Unmarshal(data, &cursor)
+	if err != nil {
+		return nil, err
+	}
+	if !cursor.ID.Valid() {
+		return nil, errInvalidID(cursor.ID)
+	}
+	return &cursor, nil
+}
+
+// sortParam is the query parameter form of the sort, like "name" or "-city".
+func (query locationQuery) sortParam() string {
+	if query.Descending {
+		return "-" + query.SortField
+	}
+	return query.SortField
+}
+
+// parseLocationQuery reads the list parameters name, city, state, zip, category,
+// owner, tag, q, sort, limit and cursor. tag may be repeated.
+func parseLocationQuery(r *http.Request) (locationQuery, error) {
+	params := r.URL.Query()
+	query := locationQuery{
+		Name:      strings.TrimSpace(params.Get("name")),
+		City:      strings.TrimSpace(params.Get("city")),
+		State:     strings.TrimSpace(params.Get("state")),
+		Zip:       strings.TrimSpace(params.Get("zip")),
+		Category:  strings.TrimSpace(params.Get("category")),
+		Owner:     strings.TrimSpace(params.Get("owner")),
+		Tags:      normalizeTags(params["tag"]),
+		Search:    strings.TrimSpace(params.Get("q")),
+		SortField: "id",
+	}
+
+	if sort := params.Get("sort"); len(sort) > 0 {
+		query.Descending = strings.HasPrefix(sort, "-")
+		query.SortField = strings.TrimPrefix(sort, "-")
+		if !locationSortFields[query.SortField] {
+			return query, badRequest("invalid_sort", "sort must be one of id, name, city, state or zip, optionally prefixed with -", map[string]string{"sort": sort})
+		}
+	}
+	limit, err := parseLimitParam(r)
+	if err != nil {
+		return query, err
+	}
+	query.Limit = limit
+	if cursor := params.Get("cursor"); len(cursor) > 0 {
+		after, err := decodeLocationCursor(cursor)
+		if err != nil || after.Sort != query.sortParam() {
+			return query, badRequest("invalid_cursor", "cursor is malformed or was issued for a different sort", nil)
+		}
+		query.After = after
+	}
+	return query, nil
+}
+
+func parseLimitParam(r *http.Request) (int, error) {
+	limit := defaultPageSize
+	if raw := r.URL.Query().Get("limit"); len(raw) > 0 {
+		value, err := strconv.Atoi(raw)
+		if err != nil || value < 1 || value > maxPageSize {
+			return 0, badRequest("invalid_limit", "limit must be a number between 1 and "+strconv.Itoa(maxPageSize), map[string]string{"limit": raw})
+		}
+		limit = value
+	}
+	return limit, nil
+}
+
+// locationSortValue is the value of the sort field of a location. The ID itself is
+// always the tie breaker, so sorting by ID has no separate value.
+func locationSortValue(location locationStruct, field string) string {
+	switch field {
+	case "name":
+		return location.Name
+	case "city":
+		return location.City
+	case "state":
+		return location.State
+	case "zip":
+		return location.Zip
+	}
+	return ""
+}
+
+// matches reports whether the location passes the filters of the query, ignoring the cursor.
+func (query locationQuery) matches(location locationStruct) bool {
+	if len(query.Name) > 0 && !strings.EqualFold(location.Name, query.Name) {
+		return false
+	}
+	if len(query.City) > 0 && !strings.EqualFold(location.City, query.City) {
+		return false
+	}
+	if len(query.State) > 0 && !strings.EqualFold(location.State, query.State) {
+		return false
+	}
+	if len(query.Zip) > 0 && !strings.EqualFold(location.Zip, query.Zip) {
+		return false
+	}
+	if len(query.Category) > 0 && !strings.EqualFold(location.Category, query.Category) {
+		return false
+	}
+	if len(query.Owner) > 0 && !strings.EqualFold(location.Owner, query.Owner) {
+		return false
+	}
+	for _, tag := range query.Tags {
+		if !hasTag(location, tag) {
+			return false
+		}
+	}
+	if len(query.Search) > 0 {
+		search := strings.ToLower(query.Search)
+		if !strings.Contains(strings.ToLower(location.Name), search) && !strings.Contains(strings.ToLower(location.Address), search) {
+			return false
+		}
+	}
+	return true
+}
+
+func hasTag(location locationStruct, tag string) bool {
+	for _, locationTag := range location.Tags {
+		if locationTag == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// less orders two locations by the sort of the query, then by ID.
+func (query locationQuery) less(a locationStruct, b locationStruct) bool {
+	valueA, valueB := locationSortValue(a, query.SortField), locationSortValue(b, query.SortField)
+	if valueA == valueB {
+		valueA, valueB = string(a.ID), string(b.ID)
+	}
+	if query.Descending {
+		return valueA > valueB
+	}
+	return valueA < valueB
+}
+
+// isAfterCursor reports whether the location belongs after the cursor of the query.
+func (query locationQuery) isAfterCursor(location locationStruct) bool {
+	if query.After == nil {
+		return true
+	}
+	var last locationStruct
+	last.ID = query.After.ID
+	switch query.SortField {
+	case "name":
+		last.Name = query.After.Value
+	case "city":
+		last.City = query.After.Value
+	case "state":
+		last.State = query.After.Value
+	case "zip":
+		last.Zip = query.After.Value
+	}
+	return query.less(last, location)
+}
+
+// newLocationPage cuts a page from locations, which hold up to query.Limit+1 sorted
+// matches. The extra match only signals that another page follows.
+func newLocationPage(query locationQuery, locations []locationStruct) locationPage {
+	page := locationPage{Locations: locations}
+	if len(locations) > query.Limit {
+		page.Locations = locations[:query.Limit]
+		last := page.Locations[query.Limit-1]
+		page.NextCursor = locationCursor{Sort: query.sortParam(), Value: locationSortValue(last, query.SortField), ID: last.ID}.encode()
+	}
+	return page
+}
+
+// forEachLocation calls fn with every location matching the filters and sort of
+// query, page by page, until fn returns false.
+func forEachLocation(query locationQuery, fn func(location locationStruct) bool) error {
+	query.Limit = maxPageSize
+	query.After = nil
+	for {
+		page, err := store.ListLocations(query)
+		if err != nil {
+			return err
+		}
+		for _, location := range page.Locations {
+			if !fn(location) {
+				return nil
+			}
+		}
+		if len(page.NextCursor) == 0 {
+			return nil
+		}
+		query.After, err = decodeLocationCursor(page.NextCursor)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func listLocations(w http.ResponseWriter, r *http.Request) {
+	query, err := parseLocationQuery(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	page, err := store.ListLocations(query)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, page)
+}
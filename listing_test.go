@@ -0,0 +1,193 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// listingStore is a memory store of six locations, two of them in Oakland so they
+// tie on the city and the ZIP code.
+func listingStore(t *testing.T) *memoryStore {
+	memory := newMemoryStore("")
+	for _, saved := range []struct{ name, address, city, state, zip, category string }{
+		{"Office", "1 Market St", "San Francisco", "CA", "94105", "work"},
+		{"Warehouse", "7 Port Rd", "Oakland", "CA", "94607", "work"},
+		{"Gym", "20 Broadway", "Oakland", "CA", "94607", "leisure"},
+		{"Lab", "3 University Ave", "Palo Alto", "CA", "94301", "work"},
+		{"Client", "9 Market St", "San Jose", "CA", "95112", ""},
+		{"Cabin", "1 Lake Rd", "Tahoe City", "NV", "96145", "leisure"},
+	} {
+		location := locationStruct{ID: bson.NewObjectId(), Name: saved.name, Address: saved.address, City: saved.city, State: saved.state, Zip: saved.zip, Category: saved.category}
+		if err := memory.InsertLocation(location); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return memory
+}
+
+// listAll follows the cursors of query from the first page and returns the locations
+// listed and the number of pages.
+func listAll(t *testing.T, memory *memoryStore, query locationQuery) ([]locationStruct, int) {
+	locations := make([]locationStruct, 0)
+	for pages := 1; ; pages++ {
+		page, err := memory.ListLocations(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page.Locations) > query.Limit {
+			t.Fatalf("got a page of %d locations, the limit is %d", len(page.Locations), query.Limit)
+		}
+		locations = append(locations, page.Locations...)
+		if len(page.NextCursor) == 0 {
+			return locations, pages
+		}
+		query.After, err = decodeLocationCursor(page.NextCursor)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestListLocationsPages(t *testing.T) {
+	memory := listingStore(t)
+	tests := []struct {
+		name  string
+		query locationQuery
+		//want lists the sort values of the locations in order
+		want []string
+	}{
+		{"by name", locationQuery{SortField: "name", Limit: 2}, []string{"Cabin", "Client", "Gym", "Lab", "Office", "Warehouse"}},
+		{"by name descending", locationQuery{SortField: "name", Descending: true, Limit: 4}, []string{"Warehouse", "Office", "Lab", "Gym", "Client", "Cabin"}},
+		{"by city", locationQuery{SortField: "city", Limit: 1}, []string{"Oakland", "Oakland", "Palo Alto", "San Francisco", "San Jose", "Tahoe City"}},
+		{"by zip descending", locationQuery{SortField: "zip", Descending: true, Limit: 3}, []string{"96145", "95112", "94607", "94607", "94301", "94105"}},
+		{"one page", locationQuery{SortField: "state", Limit: maxPageSize}, []string{"CA", "CA", "CA", "CA", "CA", "NV"}},
+	}
+	for _, test := range tests {
+		locations, pages := listAll(t, memory, test.query)
+		wantPages := (len(test.want) + test.query.Limit - 1) / test.query.Limit
+		if pages != wantPages || len(locations) != len(test.want) {
+			t.Errorf("%s: got %d locations in %d pages, want %d in %d", test.name, len(locations), pages, len(test.want), wantPages)
+			continue
+		}
+		for i, location := range locations {
+			if value := locationSortValue(location, test.query.SortField); value != test.want[i] {
+				t.Errorf("%s: location %d is %q, want %q", test.name, i, value, test.want[i])
+			}
+			//Locations that tie on the sort value are ordered by ID, so no page repeats or skips one
+			if i > 0 && locationSortValue(locations[i-1], test.query.SortField) == test.want[i] && (locations[i-1].ID < location.ID) == test.query.Descending {
+				t.Errorf("%s: locations %d and %d tie out of ID order", test.name, i-1, i)
+			}
+		}
+	}
+
+	locations, _ := listAll(t, memory, locationQuery{SortField: "id", Limit: 5})
+	for i := 1; i < len(locations); i++ {
+		if locations[i-1].ID >= locations[i].ID {
+			t.Errorf("locations %d and %d are out of ID order", i-1, i)
+		}
+	}
+	if len(locations) != 6 {
+		t.Errorf("got %d locations by ID, want 6", len(locations))
+	}
+}
+
+func TestListLocationsFilters(t *testing.T) {
+	memory := listingStore(t)
+	tests := []struct {
+		name  string
+		query locationQuery
+		want  []string
+	}{
+		{"city ignores case", locationQuery{City: "oakland"}, []string{"Gym", "Warehouse"}},
+		{"state", locationQuery{State: "nv"}, []string{"Cabin"}},
+		{"zip", locationQuery{Zip: "94105"}, []string{"Office"}},
+		{"category and city", locationQuery{Category: "work", City: "Oakland"}, []string{"Warehouse"}},
+		{"whole names only", locationQuery{Name: "Off"}, []string{}},
+		{"search in the name", locationQuery{Search: "AB"}, []string{"Cabin", "Lab"}},
+		{"search in the address", locationQuery{Search: "market"}, []string{"Client", "Office"}},
+		{"no match", locationQuery{City: "Fresno"}, []string{}},
+	}
+	for _, test := range tests {
+		test.query.SortField, test.query.Limit = "name", maxPageSize
+		locations, _ := listAll(t, memory, test.query)
+		names := make([]string, len(locations))
+		for i, location := range locations {
+			names[i] = location.Name
+		}
+		if len(names) != len(test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, names, test.want)
+			continue
+		}
+		for i := range names {
+			if names[i] != test.want[i] {
+				t.Errorf("%s: got %v, want %v", test.name, names, test.want)
+				break
+			}
+		}
+	}
+}
+
+func TestParseLocationQuery(t *testing.T) {
+	nameCursor := locationCursor{Sort: "name", Value: "Lab", ID: bson.NewObjectId()}.encode()
+	tests := []struct {
+		params   url.Values
+		wantCode string
+	}{
+		{url.Values{}, ""},
+		{url.Values{"sort": {"-city"}, "limit": {"100"}}, ""},
+		{url.Values{"sort": {"name"}, "cursor": {nameCursor}}, ""},
+		{url.Values{"sort": {"address"}}, "invalid_sort"},
+		{url.Values{"limit": {"0"}}, "invalid_limit"},
+		{url.Values{"limit": {"101"}}, "invalid_limit"},
+		{url.Values{"limit": {"ten"}}, "invalid_limit"},
+		{url.Values{"cursor": {"%%%"}}, "invalid_cursor"},
+		{url.Values{"sort": {"-name"}, "cursor": {nameCursor}}, "invalid_cursor"},
+	}
+	for _, test := range tests {
+		request, _ := http.NewRequest("GET", "/locations/?"+test.params.Encode(), nil)
+		query, err := parseLocationQuery(request)
+		if len(test.wantCode) == 0 {
+			if err != nil {
+				t.Errorf("%v: %v", test.params, err)
+			}
+			continue
+		}
+		if apiErr, ok := err.(*apiError); !ok || apiErr.Status != http.StatusBadRequest || apiErr.Code != test.wantCode {
+			t.Errorf("%v: got %+v, %v, want %s", test.params, query, err, test.wantCode)
+		}
+	}
+
+	request, _ := http.NewRequest("GET", "/locations/?name=+Lab+&q=market&sort=-zip", nil)
+	query, _ := parseLocationQuery(request)
+	if query.Name != "Lab" || query.Search != "market" || query.SortField != "zip" || !query.Descending || query.Limit != defaultPageSize {
+		t.Errorf("got %+v", query)
+	}
+}
+
+func TestListLocationsHandler(t *testing.T) {
+	server, stop := newTestServer(t)
+	defer stop()
+	for _, zip := range []string{"94105", "94607", "94301"} {
+		addTestLocation(t, server, "Stop "+zip, zip)
+	}
+
+	var page locationPage
+	if status := sendJSON(t, server, "GET", "/locations/?sort=-name&limit=2", nil, &page); status != http.StatusOK {
+		t.Fatalf("got status %d", status)
+	}
+	if len(page.Locations) != 2 || page.Locations[0].Name != "Stop 94607" || len(page.NextCursor) == 0 {
+		t.Fatalf("got first page %+v", page)
+	}
+	var last locationPage
+	sendJSON(t, server, "GET", "/locations/?sort=-name&limit=2&cursor="+page.NextCursor, nil, &last)
+	if len(last.Locations) != 1 || last.Locations[0].Name != "Stop 94105" || len(last.NextCursor) > 0 {
+		t.Errorf("got last page %+v", last)
+	}
+	var failed apiError
+	if status := sendJSON(t, server, "GET", "/locations/?sort=name&cursor="+page.NextCursor, nil, &failed); status != http.StatusBadRequest || failed.Code != "invalid_cursor" {
+		t.Errorf("a cursor of another sort got %d %q", status, failed.Code)
+	}
+}
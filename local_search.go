@@ -0,0 +1,84 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// tourWeight is the weight of the route 0 -> route... -> end, plus latenessPenalty
+// for every second it misses the time windows by. Routes breaking the ordering
+// constraints weigh +Inf, so local search never moves to them.
+func tourWeight(matrix costMatrix, route []int) float64 {
+	if !matrix.order.isEmpty() && !matrix.order.allows(route) {
+		return math.Inf(1)
+	}
+	var total float64
+	previous := 0
+	for _, next := range route {
+		total += matrix.weight(previous, next)
+		previous = next
+	}
+	total += matrix.closingWeight(previous)
+	if len(matrix.windows) > 0 {
+		_, _, lateness := matrix.schedule(route)
+		total += latenessPenalty * float64(lateness)
+	}
+	return total
+}
+
+// improveRoute runs 2-opt and Or-opt moves over route until no move lowers the
+// tour weight or the deadline passes. Weights may be asymmetric, so every
+// candidate is evaluated on the whole tour rather than on the changed edges.
+func improveRoute(matrix costMatrix, route []int, deadline time.Time) []int {
+	best := append([]int(nil), route...)
+	bestWeight := tourWeight(matrix, best)
+	candidate := make([]int, len(best))
+
+	for improved := true; improved && time.Now().Before(deadline); {
+		improved = false
+
+		//2-opt: reverse the segment best[i..j]
+		for i := 0; i < len(best)-1 && time.Now().Before(deadline); i++ {
+			for j := i + 1; j < len(best); j++ {
+				copy(candidate, best)
+				for a, b := i, j; a < b; a, b = a+1, b-1 {
+					candidate[a], candidate[b] = candidate[b], candidate[a]
+				}
+				if weight := tourWeight(matrix, candidate); weight < bestWeight {
+					best, candidate = candidate, best
+					bestWeight = weight
+					improved = true
+				}
+			}
+		}
+
+		//Or-opt: move a run of up to three consecutive stops to another position
+		for length := 1; length <= 3 && length < len(best); length++ {
+			for i := 0; i+length <= len(best) && time.Now().Before(deadline); i++ {
+				for j := 0; j <= len(best)-length; j++ {
+					if j == i {
+						continue
+					}
+					moveSegment(candidate, best, i, length, j)
+					if weight := tourWeight(matrix, candidate); weight < bestWeight {
+						best, candidate = candidate, best
+						bestWeight = weight
+						improved = true
+					}
+				}
+			}
+		}
+	}
+	return best
+}
+
+// moveSegment writes into dst the route src with src[from:from+length] removed
+// and reinserted so that it starts at index to of the result.
+func moveSegment(dst []int, src []int, from int, length int, to int) {
+	rest := make([]int, 0, len(src)-length)
+	rest = append(rest, src[:from]...)
+	rest = append(rest, src[from+length:]...)
+	n := copy(dst, rest[:to])
+	n += copy(dst[n:], src[from:from+length])
+	copy(dst[n:], rest[to:])
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"math/rand"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestImproveRouteNeverMakesRoutesHeavier(t *testing.T) {
+	tests := []struct {
+		name  string
+		stops int
+		end   int
+	}{
+		{"one stop", 1, 0},
+		{"round trip", 12, 0},
+		{"open route", 12, noRouteEnd},
+		{"fixed destination", 12, 1},
+	}
+	for _, test := range tests {
+		r := rand.New(rand.NewSource(int64(test.stops) + int64(test.end)))
+		for trial := 0; trial < 10; trial++ {
+			matrix := randomMatrix(r, test.stops, test.end)
+			stops := matrix.stops()
+			starts := map[string][]int{
+				"greedy": getCoordinates(matrix, 0, stops, make([]int, 0, len(stops))),
+				"random": r.Perm(len(stops)),
+			}
+			for i := range starts["random"] {
+				starts["random"][i]++
+			}
+			for start, route := range starts {
+				before := append([]int(nil), route...)
+				improved := improveRoute(matrix, route, time.Now().Add(time.Second))
+				if !sameStops(matrix, improved) {
+					t.Fatalf("%s from %s: improveRoute returned %v", test.name, start, improved)
+				}
+				if tourWeight(matrix, improved) > tourWeight(matrix, before) {
+					t.Errorf("%s from %s: %v weighs %v, more than %v at %v", test.name, start, improved, tourWeight(matrix, improved), before, tourWeight(matrix, before))
+				}
+				for i := range route {
+					if route[i] != before[i] {
+						t.Fatalf("%s from %s: improveRoute changed its input to %v", test.name, start, route)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestImproveRouteReachesTwoOptOptimum(t *testing.T) {
+	r := rand.New(rand.NewSource(5))
+	for trial := 0; trial < 20; trial++ {
+		matrix := randomMatrix(r, 6, 0)
+		route := improveRoute(matrix, matrix.stops(), time.Now().Add(time.Second))
+		weight := tourWeight(matrix, route)
+		//No single reversal may improve on a route local search settled on
+		for i := 0; i < len(route)-1; i++ {
+			for j := i + 1; j < len(route); j++ {
+				reversed := append([]int(nil), route...)
+				for a, b := i, j; a < b; a, b = a+1, b-1 {
+					reversed[a], reversed[b] = reversed[b], reversed[a]
+				}
+				if tourWeight(matrix, reversed) < weight {
+					t.Fatalf("reversing %d..%d of %v lowers its weight %v to %v", i, j, route, weight, tourWeight(matrix, reversed))
+				}
+			}
+		}
+	}
+}
+
+func TestImproveRouteStopsAtDeadline(t *testing.T) {
+	matrix := randomMatrix(rand.New(rand.NewSource(9)), 8, 0)
+	route := []int{8, 7, 6, 5, 4, 3, 2, 1}
+	improved := improveRoute(matrix, route, time.Now().Add(-time.Second))
+	for i := range route {
+		if improved[i] != route[i] {
+			t.Fatalf("improveRoute moved to %v after its deadline", improved)
+		}
+	}
+}
+
+func TestMoveSegment(t *testing.T) {
+	tests := []struct {
+		from   int
+		length int
+		to     int
+		want   []int
+	}{
+		{0, 1, 2, []int{2, 3, 1, 4, 5}},
+		{3, 2, 0, []int{4, 5, 1, 2, 3}},
+		{1, 3, 2, []int{1, 5, 2, 3, 4}},
+		{4, 1, 1, []int{1, 5, 2, 3, 4}},
+	}
+	for _, test := range tests {
+		src := []int{1, 2, 3, 4, 5}
+		dst := make([]int, len(src))
+		moveSegment(dst, src, test.from, test.length, test.to)
+		for i := range dst {
+			if dst[i] != test.want[i] {
+				t.Errorf("moveSegment(%d, %d, %d) = %v, want %v", test.from, test.length, test.to, dst, test.want)
+				break
+			}
+		}
+	}
+}
+
+func TestOptimizeRouteReportsGreedyAndImprovedCosts(t *testing.T) {
+	defer func(maxExact int, budget time.Duration) {
+		config.MaxExactStops, config.LocalSearchBudget = maxExact, budget
+	}(config.MaxExactStops, config.LocalSearchBudget)
+	config.MaxExactStops, config.LocalSearchBudget = 0, time.Second
+
+	r := rand.New(rand.NewSource(23))
+	for trial := 0; trial < 10; trial++ {
+		matrix := randomMatrix(r, 10, 0)
+		plan := optimizeRoute(matrix)
+		greedy := getCoordinates(matrix, 0, matrix.stops(), nil)
+		if want := matrix.routePrice(greedy).Low; plan.GreedyCost != want {
+			t.Errorf("got greedy cost %d, the greedy route is priced at %d", plan.GreedyCost, want)
+		}
+		if want := matrix.routePrice(plan.Route).Low; plan.ImprovedCost != want || plan.ImprovedCost > plan.GreedyCost {
+			t.Errorf("got improved cost %d after %d, the route is priced at %d", plan.ImprovedCost, plan.GreedyCost, want)
+		}
+
+		//Two stops are due before they can be reached, so every route is late. The
+		//weights carry the lateness penalty, the costs stay prices.
+		matrix.windows = map[int]stopWindow{3: {Latest: 30}, 7: {Latest: 30}}
+		plan = optimizeRoute(matrix)
+		if want := matrix.routePrice(plan.Route).Low; plan.ImprovedCost != want || plan.ImprovedWeight < latenessPenalty {
+			t.Errorf("got improved cost %d and weight %v, the route is priced at %d", plan.ImprovedCost, plan.ImprovedWeight, want)
+		}
+	}
+}
+
+func TestPlanTripReportsLocalSearchSavings(t *testing.T) {
+	defer func(maxExact int, budget time.Duration) {
+		config.MaxExactStops, config.LocalSearchBudget = maxExact, budget
+	}(config.MaxExactStops, config.LocalSearchBudget)
+	config.MaxExactStops, config.LocalSearchBudget = 0, time.Second
+	server, stop := newTestServer(t)
+	defer stop()
+
+	request := UberPostRequest{StartingFromLocationID: addTestLocation(t, server, "Office", "94105")}
+	for _, zip := range []string{"95112", "94301", "94607"} {
+		request.LocationIds = append(request.LocationIds, addTestLocation(t, server, "Stop "+zip, zip))
+	}
+	var trip UberResponse
+	if status := sendJSON(t, server, "POST", "/trips/", request, &trip); status != http.StatusCreated {
+		t.Fatalf("got status %d", status)
+	}
+	if trip.PlanningMethod != planningMethodLocalSearch || trip.ImprovedLowEstimate != trip.TotalLowEstimate || trip.GreedyLowEstimate < trip.ImprovedLowEstimate {
+		t.Errorf("got %s with greedy %d, improved %d and total %d", trip.PlanningMethod, trip.GreedyLowEstimate, trip.ImprovedLowEstimate, trip.TotalLowEstimate)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+)
+
+// mergePatch applies an RFC 7396 JSON Merge Patch to target, both decoded into
+// interface{} values. Objects are merged key by key, a null removes the key and
+// anything else replaces the target value.
+func mergePatch(target interface{}, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	targetObject, ok := target.(map[string]interface{})
+	if !ok {
+		targetObject = make(map[string]interface{})
+	}
+	for key, value := range patchObject {
+		if value == nil {
+			delete(targetObject, key)
+		} else {
+			targetObject[key] = mergePatch(targetObject[key], value)
+		}
+	}
+	return targetObject
+}
+
+// applyMergePatch patches the JSON form of original and decodes the result into output.
+func applyMergePatch(original interface{}, patch map[string]interface{}, output interface{}) error {
+	originalJSON, err := json.Marshal(original)
+	if err != nil {
+		return err
+	}
+	var target interface{}
+	err = json.Unmarshal(originalJSON, &target)
+	if err != nil {
+		return err
+	}
+	mergedJSON, err := json.Marshal(mergePatch(target, patch))
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(mergedJSON, output)
+	if err != nil {
+		return badRequest("invalid_patch", "The patched document is not valid", err.Error())
+	}
+	return nil
+}
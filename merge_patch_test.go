@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestMergePatch(t *testing.T) {
+	//The examples of RFC 7396, appendix A
+	tests := []struct {
+		target, patch, want string
+	}{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+		{`{"a":"b"}`, `["c"]`, `["c"]`},
+		{`{"a":"foo"}`, `null`, `null`},
+		{`{"a":"foo"}`, `"bar"`, `"bar"`},
+		{`{"e":null}`, `{"a":1}`, `{"e":null,"a":1}`},
+		{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+	}
+	for _, test := range tests {
+		var target, patch, want interface{}
+		json.Unmarshal([]byte(test.target), &target)
+		json.Unmarshal([]byte(test.patch), &patch)
+		json.Unmarshal([]byte(test.want), &want)
+		if got := mergePatch(target, patch); !reflect.DeepEqual(got, want) {
+			t.Errorf("patching %s with %s gave %v, want %s", test.target, test.patch, got, test.want)
+		}
+	}
+}
+
+func TestApplyMergePatch(t *testing.T) {
+	saved := locationStruct{Name: "Office", Address: "1 Main St", Zip: "94105", Notes: "Ring twice", Tags: []string{"work"}}
+	var patched locationStruct
+	if err := applyMergePatch(saved, map[string]interface{}{"notes": nil, "name": "Head office"}, &patched); err != nil {
+		t.Fatal(err)
+	}
+	if patched.Name != "Head office" || patched.Notes != "" || patched.Address != saved.Address || len(patched.Tags) != 1 {
+		t.Errorf("got %+v", patched)
+	}
+	err := applyMergePatch(saved, map[string]interface{}{"zip": 94105}, &patched)
+	if apiErr, ok := err.(*apiError); !ok || apiErr.Code != "invalid_patch" {
+		t.Errorf("a number for the ZIP code returned %v", err)
+	}
+}
+
+func TestPatchAndReplaceLocation(t *testing.T) {
+	server, stop := newTestServer(t)
+	defer stop()
+	id := addTestLocation(t, server, "Office", "94105")
+	stub := &stubGeocoder{results: map[string][]geocodeResult{
+		"1 Main St, 94105": {testZips["94105"]},
+		"1 Main St, 95112": {testZips["95112"]},
+		"2 Main St, 95112": {testZips["95112"]},
+	}}
+	locationGeocoder = stub
+
+	var location locationStruct
+	_, header := sendJSONWithHeader(t, server, "GET", "/locations/"+id, nil, nil, &location)
+	etag := header.Get("ETag")
+	send := func(method string, body interface{}) (int, locationStruct, string) {
+		var response struct {
+			locationStruct
+			Code string `json:"code"`
+		}
+		status, header := sendJSONWithHeader(t, server, method, "/locations/"+id, http.Header{"If-Match": {etag}}, body, &response)
+		if status == http.StatusOK {
+			etag = header.Get("ETag")
+		}
+		return status, response.locationStruct, response.Code
+	}
+
+	tests := []struct {
+		name         string
+		method       string
+		body         interface{}
+		wantStatus   int
+		wantCode     string
+		wantGeocodes int
+		check        func(location locationStruct) bool
+	}{
+		{"patch the name", "PATCH", map[string]interface{}{"name": "Head office", "notes": "Ring twice"}, http.StatusOK, "", 0,
+			func(patched locationStruct) bool {
+				return patched.Name == "Head office" && patched.Notes == "Ring twice" && patched.Zip == "94105" && patched.Coordinate == location.Coordinate
+			}},
+		{"null removes a field", "PATCH", map[string]interface{}{"notes": nil}, http.StatusOK, "", 0,
+			func(patched locationStruct) bool { return patched.Notes == "" && patched.Name == "Head office" }},
+		{"patch the address", "PATCH", map[string]interface{}{"zip": "95112"}, http.StatusOK, "", 1,
+			func(patched locationStruct) bool {
+				return patched.Address == "1 Main St" && patched.Coordinate.Lat == testZips["95112"].Lat && patched.PlaceID == "zip:95112"
+			}},
+		{"null coordinate geocodes again", "PATCH", map[string]interface{}{"coordinate": nil}, http.StatusOK, "", 2,
+			func(patched locationStruct) bool { return patched.Coordinate.Lat == testZips["95112"].Lat }},
+		{"id cannot change", "PATCH", map[string]interface{}{"id": "5717c9e8a2c3c1b8e4a3d4f1"}, http.StatusBadRequest, "immutable_field", 2, nil},
+		{"name cannot be removed", "PATCH", map[string]interface{}{"name": nil}, http.StatusBadRequest, "missing_name", 2, nil},
+		{"replace clears the rest", "PUT", map[string]string{"name": "Office", "address": "2 Main St", "zip": "95112"}, http.StatusOK, "", 3,
+			func(replaced locationStruct) bool {
+				return replaced.Name == "Office" && replaced.Notes == "" && replaced.Address == "2 Main St"
+			}},
+		{"replace needs a name", "PUT", map[string]string{"address": "2 Main St", "zip": "95112"}, http.StatusBadRequest, "missing_name", 3, nil},
+	}
+	version := location.Version
+	for _, test := range tests {
+		status, patched, code := send(test.method, test.body)
+		if status != test.wantStatus || code != test.wantCode || stub.geocodes != test.wantGeocodes {
+			t.Errorf("%s: got %d %q after %d geocodes, want %d %q after %d", test.name, status, code, stub.geocodes, test.wantStatus, test.wantCode, test.wantGeocodes)
+			continue
+		}
+		if status != http.StatusOK {
+			continue
+		}
+		version++
+		if patched.Version != version || etag != versionETag(version) || !test.check(patched) {
+			t.Errorf("%s: got %+v with ETag %s", test.name, patched, etag)
+		}
+	}
+}
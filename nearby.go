@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+const maxNearbyRadiusMiles float64 = 500
+
+// nearbyLocation is a location with its distance in miles from the point searched around.
+type nearbyLocation struct {
+	locationStruct
+	Distance float64 `json:"distance"`
+}
+
+type nearbyResponse struct {
+	Locations []nearbyLocation `json:"locations"`
+}
+
+// sortByDistance measures each location from lat/lng and orders them nearest first,
+// keeping at most limit.
+func sortByDistance(locations []locationStruct, lat float64, lng float64, limit int) []nearbyLocation {
+	nearby := make([]nearbyLocation, len(locations))
+	for i, location := range locations {
+		nearby[i] = nearbyLocation{location, haversineMiles(lat, lng, location.Coordinate.Lat, location.Coordinate.Lng)}
+	}
+	sort.Slice(nearby, func(i, j int) bool { return nearby[i].Distance < nearby[j].Distance })
+	if len(nearby) > limit {
+		nearby = nearby[:limit]
+	}
+	return nearby
+}
+
+func parseFloatParam(r *http.Request, name string, min float64, max float64) (float64, error) {
+	raw := r.URL.Query().Get(name)
+	value, err := strconv.ParseFloat(raw, 64)
+	if err != nil || value < min || value > max {
+		return 0, badRequest("invalid_"+name, name+" must be a number between "+strconv.FormatFloat(min, 'f', -1, 64)+" and "+strconv.FormatFloat(max, 'f', -1, 64), map[string]string{name: raw})
+	}
+	return value, nil
+}
+
+// findNearbyLocations serves GET /locations/nearby?lat=&lng=&radius= with the radius in miles.
+func findNearbyLocations(w http.ResponseWriter, r *http.Request) {
+	lat, err := parseFloatParam(r, "lat", -90, 90)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	lng, err := parseFloatParam(r, "lng", -180, 180)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	radius, err := parseFloatParam(r, "radius", 0, maxNearbyRadiusMiles)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	limit, err := parseLimitParam(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	locations, err := store.NearbyLocations(lat, lng, radius, limit)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, nearbyResponse{Locations: locations})
+}
+
+// findLocationsWithin serves GET /locations/within?south=&west=&north=&east=, sorted
+// by distance from the center of the box.
+func findLocationsWithin(w http.ResponseWriter, r *http.Request) {
+	var box geoBox
+	var err error
+	for _, bound := range []struct {
+		name  string
+		value *float64
+		limit float64
+	}{{"south", &box.South, 90}, {"west", &box.West, 180}, {"north", &box.North, 90}, {"east", &box.East, 180}} {
+		*bound.value, err = parseFloatParam(r, bound.name, -bound.limit, bound.limit)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+	if box.South > box.North {
+		writeError(w, badRequest("invalid_box", "south must not be greater than north", box))
+		return
+	}
+	limit, err := parseLimitParam(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	locations, err := store.LocationsWithin(box, limit)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, nearbyResponse{Locations: locations})
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"math/rand"
+	"net/http"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// scatteredStore saves count locations around lat/lng, up to spread degrees away.
+func scatteredStore(t *testing.T, r *rand.Rand, count int, lat float64, lng float64, spread float64) *memoryStore {
+	memory := newMemoryStore("")
+	for i := 0; i < count; i++ {
+		location := locationStruct{ID: bson.NewObjectId()}
+		location.Coordinate.Lat = lat + (r.Float64()*2-1)*spread
+		location.Coordinate.Lng = normalizeLng(lng + (r.Float64()*2-1)*spread)
+		if err := memory.InsertLocation(location); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return memory
+}
+
+func TestNearbyLocationsMatchesBruteForce(t *testing.T) {
+	r := rand.New(rand.NewSource(5))
+	//The second store straddles the antimeridian
+	for _, center := range [][2]float64{{37.7, -122.4}, {-16.5, 179.8}} {
+		memory := scatteredStore(t, r, 300, center[0], center[1], 2)
+		for trial := 0; trial < 30; trial++ {
+			lat, lng := center[0]+r.Float64()-0.5, normalizeLng(center[1]+r.Float64()-0.5)
+			radius := r.Float64() * 100
+			want := 0
+			for _, location := range memory.locations {
+				if haversineMiles(lat, lng, location.Coordinate.Lat, location.Coordinate.Lng) <= radius {
+					want++
+				}
+			}
+
+			nearby, err := memory.NearbyLocations(lat, lng, radius, 1000)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(nearby) != want {
+				t.Fatalf("found %d locations within %v miles of %v, %v, want %d", len(nearby), radius, lat, lng, want)
+			}
+			for i, location := range nearby {
+				if location.Distance > radius || (i > 0 && location.Distance < nearby[i-1].Distance) {
+					t.Fatalf("location %d is %v miles away, after %v", i, location.Distance, nearby[i-1].Distance)
+				}
+			}
+			if limited, _ := memory.NearbyLocations(lat, lng, radius, 3); want >= 3 && (len(limited) != 3 || limited[2].ID != nearby[2].ID) {
+				t.Fatalf("the three nearest are %+v, want the first of %+v", limited, nearby)
+			}
+		}
+	}
+}
+
+func TestLocationsWithinMatchesBruteForce(t *testing.T) {
+	r := rand.New(rand.NewSource(9))
+	memory := scatteredStore(t, r, 300, 0, 180, 3)
+	boxes := []geoBox{
+		{South: -1, West: 178, North: 2, East: -179},
+		{South: -3, West: -180, North: 3, East: -177},
+		{South: 0.5, West: 179, North: 0.6, East: 179.1},
+	}
+	for _, box := range boxes {
+		want := 0
+		for _, location := range memory.locations {
+			if box.contains(location.Coordinate.Lat, location.Coordinate.Lng) {
+				want++
+			}
+		}
+		within, err := memory.LocationsWithin(box, 1000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(within) != want {
+			t.Errorf("found %d locations within %+v, want %d", len(within), box, want)
+		}
+		for i := 1; i < len(within); i++ {
+			if within[i].Distance < within[i-1].Distance {
+				t.Errorf("%+v: location %d is nearer the center than the one before", box, i)
+			}
+		}
+	}
+}
+
+func TestGeoIndexFollowsChanges(t *testing.T) {
+	memory := newMemoryStore("")
+	location := testLocation("Office", 1)
+	memory.InsertLocation(location)
+
+	moved := location
+	moved.Coordinate.Lat, moved.Coordinate.Lng = testZips["95112"].Lat, testZips["95112"].Lng
+	moved.Version = 2
+	memory.UpdateLocation(moved, 1)
+	if nearby, _ := memory.NearbyLocations(location.Coordinate.Lat, location.Coordinate.Lng, 5, 10); len(nearby) != 0 {
+		t.Errorf("the location is still found at its old place, %+v", nearby)
+	}
+	if nearby, _ := memory.NearbyLocations(moved.Coordinate.Lat, moved.Coordinate.Lng, 5, 10); len(nearby) != 1 {
+		t.Errorf("the location is not found at its new place")
+	}
+
+	memory.DeleteLocation(location.ID.Hex(), 2)
+	if len(memory.geoIndex) != 0 || len(memory.geohashes) != 0 {
+		t.Errorf("the deleted location is still indexed, %v", memory.geoIndex)
+	}
+}
+
+func TestNearbyHandlers(t *testing.T) {
+	server, stop := newTestServer(t)
+	defer stop()
+	office := addTestLocation(t, server, "Office", "94105")
+	addTestLocation(t, server, "Warehouse", "94607")
+	addTestLocation(t, server, "Client", "95112")
+
+	sanFrancisco := testZips["94105"]
+	var found nearbyResponse
+	//Oakland is about 8 miles from the office, San Jose more than 40
+	path := "/locations/nearby?lat=" + formatCoordinate(sanFrancisco.Lat) + "&lng=" + formatCoordinate(sanFrancisco.Lng) + "&radius=20"
+	if status := sendJSON(t, server, "GET", path, nil, &found); status != http.StatusOK {
+		t.Fatalf("got status %d", status)
+	}
+	if len(found.Locations) != 2 || found.Locations[0].ID.Hex() != office || found.Locations[1].Name != "Warehouse" {
+		t.Errorf("got %+v", found.Locations)
+	}
+
+	found = nearbyResponse{}
+	sendJSON(t, server, "GET", "/locations/within?south=37&west=-122.5&north=38&east=-121.5&limit=1", nil, &found)
+	if len(found.Locations) != 1 {
+		t.Errorf("got %+v with a limit of 1", found.Locations)
+	}
+
+	tests := []struct {
+		path     string
+		wantCode string
+	}{
+		{"/locations/nearby?lat=91&lng=0&radius=1", "invalid_lat"},
+		{"/locations/nearby?lat=0&lng=west&radius=1", "invalid_lng"},
+		{"/locations/nearby?lat=0&lng=0", "invalid_radius"},
+		{"/locations/nearby?lat=0&lng=0&radius=501", "invalid_radius"},
+		{"/locations/within?south=1&west=0&north=0&east=1", "invalid_box"},
+		{"/locations/within?south=0&west=0&north=1", "invalid_east"},
+	}
+	for _, test := range tests {
+		var failed apiError
+		if status := sendJSON(t, server, "GET", test.path, nil, &failed); status != http.StatusBadRequest || failed.Code != test.wantCode {
+			t.Errorf("%s: got %d %q, want %s", test.path, status, failed.Code, test.wantCode)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+)
+
+const objectiveCheapest string = "cheapest"
+const objectiveFastest string = "fastest"
+const objectiveShortest string = "shortest"
+const objectiveWeighted string = "weighted"
+
+// ObjectiveWeights is the relative importance of price, time and distance in a
+// weighted objective. Each metric is divided by its mean over the trip before
+// weighting so that dollars, seconds and miles can be blended.
+type ObjectiveWeights struct {
+	Cost     float64 `json:"cost" bson:"cost"`
+	Duration float64 `json:"duration" bson:"duration"`
+	Distance float64 `json:"distance" bson:"distance"`
+}
+
+// tripObjective is what the planner minimizes for each leg.
+type tripObjective struct {
+	Name    string
+	Weights ObjectiveWeights
+}
+
+// parseObjective validates the objective of a trip request. An empty objective
+// keeps the original behaviour of minimizing the low estimate.
+func parseObjective(request UberPostRequest) (tripObjective, error) {
+	switch request.Objective {
+	case "", objectiveCheapest:
+		return tripObjective{Name: objectiveCheapest, Weights: ObjectiveWeights{Cost: 1}}, nil
+	case objectiveFastest:
+		return tripObjective{Name: objectiveFastest, Weights: ObjectiveWeights{Duration: 1}}, nil
+	case objectiveShortest:
+		return tripObjective{Name: objectiveShortest, Weights: ObjectiveWeights{Distance: 1}}, nil
+	case objectiveWeighted:
+		if request.ObjectiveWeights == nil {
+			return tripObjective{}, fmt.Errorf("objective %q requires objective_weights", objectiveWeighted)
+		}
+		weights := *request.ObjectiveWeights
+		if weights.Cost < 0 || weights.Duration < 0 || weights.Distance < 0 {
+			return tripObjective{}, fmt.Errorf("objective_weights must not be negative")
+		}
+		if weights.Cost+weights.Duration+weights.Distance == 0 {
+			return tripObjective{}, fmt.Errorf("objective_weights must not all be zero")
+		}
+		return tripObjective{Name: objectiveWeighted, Weights: weights}, nil
+	}
+	return tripObjective{}, fmt.Errorf("unknown objective %q, expected one of %s, %s, %s or %s",
+		request.Objective, objectiveCheapest, objectiveFastest, objectiveShortest, objectiveWeighted)
+}
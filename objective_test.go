@@ -0,0 +1,136 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestParseObjective(t *testing.T) {
+	tests := []struct {
+		name      string
+		objective string
+		weights   *ObjectiveWeights
+		want      tripObjective
+		wantErr   bool
+	}{
+		{"default", "", nil, tripObjective{Name: objectiveCheapest, Weights: ObjectiveWeights{Cost: 1}}, false},
+		{"cheapest", objectiveCheapest, nil, tripObjective{Name: objectiveCheapest, Weights: ObjectiveWeights{Cost: 1}}, false},
+		{"fastest", objectiveFastest, nil, tripObjective{Name: objectiveFastest, Weights: ObjectiveWeights{Duration: 1}}, false},
+		{"shortest", objectiveShortest, nil, tripObjective{Name: objectiveShortest, Weights: ObjectiveWeights{Distance: 1}}, false},
+		{"weighted", objectiveWeighted, &ObjectiveWeights{Cost: 2, Duration: 1}, tripObjective{Name: objectiveWeighted, Weights: ObjectiveWeights{Cost: 2, Duration: 1}}, false},
+		{"weighted without weights", objectiveWeighted, nil, tripObjective{}, true},
+		{"negative weight", objectiveWeighted, &ObjectiveWeights{Cost: 1, Distance: -1}, tripObjective{}, true},
+		{"zero weights", objectiveWeighted, &ObjectiveWeights{}, tripObjective{}, true},
+		{"unknown", "scenic", nil, tripObjective{}, true},
+	}
+	for _, test := range tests {
+		got, err := parseObjective(UberPostRequest{Objective: test.objective, ObjectiveWeights: test.weights})
+		if (err != nil) != test.wantErr || got != test.want {
+			t.Errorf("%s: got %+v, %v, want %+v", test.name, got, err, test.want)
+		}
+	}
+}
+
+// objectiveMatrix is an open route over two stops. Going to stop 1 first is cheap
+// and short but slow, going to stop 2 first is fast.
+func objectiveMatrix() costMatrix {
+	matrix := costMatrix{locations: make([]locationStruct, 3), end: noRouteEnd}
+	matrix.legs = [][]legEstimate{
+		{{}, {Cost: 100, Duration: 1000, Distance: 1}, {Cost: 500, Duration: 10, Distance: 5}},
+		{{Cost: 100, Duration: 1000, Distance: 1}, {}, {Cost: 100, Duration: 1000, Distance: 1}},
+		{{Cost: 500, Duration: 10, Distance: 5}, {Cost: 500, Duration: 10, Distance: 5}, {}},
+	}
+	return matrix
+}
+
+func TestApplyObjective(t *testing.T) {
+	//The off-diagonal means are 300 cents, 505 seconds and 3 miles
+	tests := []struct {
+		name    string
+		weights ObjectiveWeights
+		//want is the weight of the legs 0 -> 1 and 0 -> 2
+		want [2]float64
+	}{
+		{objectiveCheapest, ObjectiveWeights{Cost: 1}, [2]float64{100, 500}},
+		{objectiveFastest, ObjectiveWeights{Duration: 1}, [2]float64{1000, 10}},
+		{objectiveShortest, ObjectiveWeights{Distance: 1}, [2]float64{1, 5}},
+		{objectiveWeighted, ObjectiveWeights{Cost: 3, Distance: 3}, [2]float64{100.0/300*3 + 1.0/3*3, 500.0/300*3 + 5.0/3*3}},
+	}
+	for _, test := range tests {
+		matrix := objectiveMatrix()
+		matrix.applyObjective(tripObjective{Name: test.name, Weights: test.weights})
+		for i, want := range test.want {
+			if got := matrix.weight(0, i+1); got < want-1e-9 || got > want+1e-9 {
+				t.Errorf("%s: leg 0 -> %d weighs %v, want %v", test.name, i+1, got, want)
+			}
+		}
+	}
+}
+
+func TestObjectiveChoosesRoute(t *testing.T) {
+	tests := []struct {
+		objective tripObjective
+		want      []int
+	}{
+		{tripObjective{Name: objectiveCheapest, Weights: ObjectiveWeights{Cost: 1}}, []int{1, 2}},
+		{tripObjective{Name: objectiveFastest, Weights: ObjectiveWeights{Duration: 1}}, []int{2, 1}},
+		{tripObjective{Name: objectiveShortest, Weights: ObjectiveWeights{Distance: 1}}, []int{1, 2}},
+		{tripObjective{Name: objectiveWeighted, Weights: ObjectiveWeights{Cost: 1, Duration: 10}}, []int{2, 1}},
+	}
+	for _, test := range tests {
+		matrix := objectiveMatrix()
+		matrix.applyObjective(test.objective)
+		route, _ := solveExactTour(matrix)
+		greedy := getCoordinates(matrix, 0, matrix.stops(), nil)
+		if len(route) != 2 || route[0] != test.want[0] || greedy[0] != test.want[0] {
+			t.Errorf("%s: exact route %v and greedy route %v, want %v", test.objective.Name, route, greedy, test.want)
+		}
+	}
+}
+
+func TestPlanTripRecordsObjective(t *testing.T) {
+	server, stop := newTestServer(t)
+	defer stop()
+	start := addTestLocation(t, server, "Office", "94105")
+	stops := []string{addTestLocation(t, server, "Client", "95112"), addTestLocation(t, server, "Lab", "94301")}
+
+	tests := []struct {
+		objective   string
+		weights     *ObjectiveWeights
+		wantStatus  int
+		wantWeights bool
+	}{
+		{"", nil, http.StatusCreated, false},
+		{objectiveFastest, nil, http.StatusCreated, false},
+		{objectiveWeighted, &ObjectiveWeights{Cost: 1, Duration: 2}, http.StatusCreated, true},
+		{objectiveWeighted, nil, http.StatusBadRequest, false},
+		{"scenic", nil, http.StatusBadRequest, false},
+	}
+	for _, test := range tests {
+		request := UberPostRequest{StartingFromLocationID: start, LocationIds: stops, Objective: test.objective, ObjectiveWeights: test.weights}
+		var trip struct {
+			UberResponse
+			Code string `json:"code"`
+		}
+		status := sendJSON(t, server, "POST", "/trips/", request, &trip)
+		if status != test.wantStatus {
+			t.Errorf("%q: got status %d, want %d", test.objective, status, test.wantStatus)
+			continue
+		}
+		if status != http.StatusCreated {
+			if trip.Code != "invalid_objective" {
+				t.Errorf("%q: got code %q", test.objective, trip.Code)
+			}
+			continue
+		}
+		want, _ := parseObjective(request)
+		var saved UberResponse
+		sendJSON(t, server, "GET", "/trips/"+trip.ID.Hex(), nil, &saved)
+		if saved.Objective != want.Name || (saved.ObjectiveWeights != nil) != test.wantWeights {
+			t.Errorf("%q: the saved trip has objective %q and weights %v", test.objective, saved.Objective, saved.ObjectiveWeights)
+		}
+		if test.wantWeights && *saved.ObjectiveWeights != *test.weights {
+			t.Errorf("%q: got weights %+v, want %+v", test.objective, *saved.ObjectiveWeights, *test.weights)
+		}
+	}
+}
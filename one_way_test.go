@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestTripEnd(t *testing.T) {
+	yes, no := true, false
+	tests := []struct {
+		name       string
+		request    UberPostRequest
+		wantOneWay bool
+		wantEnd    string
+		wantErr    bool
+	}{
+		{"round trip by default", UberPostRequest{StartingFromLocationID: "a"}, false, "", false},
+		{"open one way trip", UberPostRequest{StartingFromLocationID: "a", RoundTrip: &no}, true, "", false},
+		{"fixed destination", UberPostRequest{StartingFromLocationID: "a", EndingAtLocationID: "b"}, true, "b", false},
+		{"ending at the start", UberPostRequest{StartingFromLocationID: "a", EndingAtLocationID: "a", RoundTrip: &no}, false, "", false},
+		{"round trip to elsewhere", UberPostRequest{StartingFromLocationID: "a", EndingAtLocationID: "b", RoundTrip: &yes}, false, "", true},
+	}
+	for _, test := range tests {
+		oneWay, end, err := tripEnd(test.request)
+		if oneWay != test.wantOneWay || end != test.wantEnd || (err != nil) != test.wantErr {
+			t.Errorf("%s: got %v, %q, %v", test.name, oneWay, end, err)
+		}
+	}
+}
+
+func TestPlanOneWayTrips(t *testing.T) {
+	server, stop := newTestServer(t)
+	defer stop()
+	start := addTestLocation(t, server, "Office", "94105")
+	airport := addTestLocation(t, server, "Airport", "95112")
+	stops := []string{addTestLocation(t, server, "Lab", "94301"), addTestLocation(t, server, "Warehouse", "94607")}
+	no := false
+
+	//The destination is visited last even when it is listed as a stop
+	request := UberPostRequest{StartingFromLocationID: start, LocationIds: append([]string{airport}, stops...), EndingAtLocationID: airport}
+	var trip UberResponse
+	if status := sendJSON(t, server, "POST", "/trips/", request, &trip); status != http.StatusCreated {
+		t.Fatalf("got status %d", status)
+	}
+	route := trip.BestRouteLocationIds
+	if !trip.OneWay || trip.EndingAtLocationID != airport || len(route) != 3 || route[2] != airport || len(trip.Legs) != 3 || trip.Legs[2].ToLocationID != airport {
+		t.Errorf("got route %v ending at %s with %d legs", route, trip.EndingAtLocationID, len(trip.Legs))
+	}
+
+	//Only the destination is enough for a trip
+	request = UberPostRequest{StartingFromLocationID: start, EndingAtLocationID: airport}
+	if status := sendJSON(t, server, "POST", "/trips/", request, &trip); status != http.StatusCreated || len(trip.BestRouteLocationIds) != 1 || len(trip.Legs) != 1 {
+		t.Errorf("a trip straight to the destination got %d %v", status, trip.BestRouteLocationIds)
+	}
+
+	//An open trip ends at its last stop, without a leg back
+	request = UberPostRequest{StartingFromLocationID: start, LocationIds: stops, RoundTrip: &no}
+	if status := sendJSON(t, server, "POST", "/trips/", request, &trip); status != http.StatusCreated {
+		t.Fatalf("got status %d", status)
+	}
+	last := trip.BestRouteLocationIds[len(trip.BestRouteLocationIds)-1]
+	if !trip.OneWay || trip.EndingAtLocationID != last || len(trip.Legs) != 2 {
+		t.Errorf("the open trip ends at %s after %d legs, its last stop is %s", trip.EndingAtLocationID, len(trip.Legs), last)
+	}
+
+	var failed apiError
+	yes := true
+	request = UberPostRequest{StartingFromLocationID: start, LocationIds: stops, EndingAtLocationID: airport, RoundTrip: &yes}
+	if status := sendJSON(t, server, "POST", "/trips/", request, &failed); status != http.StatusBadRequest || failed.Code != "conflicting_trip_end" {
+		t.Errorf("a round trip to another location got %d %q", status, failed.Code)
+	}
+	request = UberPostRequest{StartingFromLocationID: start, EndingAtLocationID: start}
+	if status := sendJSON(t, server, "POST", "/trips/", request, &failed); status != http.StatusBadRequest || failed.Code != "missing_locations" {
+		t.Errorf("a trip ending at its start without stops got %d %q", status, failed.Code)
+	}
+}
+
+func TestRequestTripCompletesAtTheDestination(t *testing.T) {
+	server, stop := newTestServer(t)
+	defer stop()
+	start := addTestLocation(t, server, "Office", "94105")
+	airport := addTestLocation(t, server, "Airport", "95112")
+	var trip UberResponse
+	sendJSON(t, server, "POST", "/trips/", UberPostRequest{StartingFromLocationID: start, EndingAtLocationID: airport}, &trip)
+
+	//The ride to the destination was booked, so the next request completes the trip
+	//without booking a ride home
+	trip.Status, trip.NextDestinationLocationID = "requesting", airport
+	trip.Version++
+	if err := store.UpdateTrip(trip, trip.Version-1); err != nil {
+		t.Fatal(err)
+	}
+	var completed UberResponse
+	status, _ := sendJSONWithHeader(t, server, "PUT", "/trips/"+trip.ID.Hex()+"/request", http.Header{"If-Match": {versionETag(trip.Version)}}, nil, &completed)
+	if status != http.StatusOK || completed.Status != "completed" || completed.NextDestinationLocationID != airport {
+		t.Errorf("got %d, status %q and next destination %s", status, completed.Status, completed.NextDestinationLocationID)
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"math/bits"
+	"sort"
+)
+
+// precedenceRule asks for the location Before to be visited before the location After.
+type precedenceRule struct {
+	Before string `json:"before"`
+	After  string `json:"after"`
+}
+
+// pinnedStop fixes a location at a position of the route, 1 being the first stop
+// after the start.
+type pinnedStop struct {
+	LocationID string `json:"location_id"`
+	Position   int    `json:"position"`
+}
+
+// routeOrder holds the ordering constraints of a cost matrix by location index.
+// The zero value has no constraints.
+type routeOrder struct {
+	//predecessors[i] lists the locations that must be visited before location i
+	predecessors map[int][]int
+	//pinned maps a location to its position and positions maps it back
+	pinned    map[int]int
+	positions map[int]int
+}
+
+func (order routeOrder) isEmpty() bool {
+	return len(order.predecessors) == 0 && len(order.pinned) == 0
+}
+
+// canVisit reports whether location next may be visited at position once the
+// locations reported by visited are.
+func (order routeOrder) canVisit(next int, position int, visited func(int) bool) bool {
+	for _, before := range order.predecessors[next] {
+		if !visited(before) {
+			return false
+		}
+	}
+	if pinned, ok := order.pinned[next]; ok {
+		return pinned == position
+	}
+	_, taken := order.positions[position]
+	return !taken
+}
+
+// canFollow is canVisit for the subsets of solveExactTour, where location i is
+// bit i-1 of mask.
+func (order routeOrder) canFollow(mask int, next int) bool {
+	return order.canVisit(next, bits.OnesCount(uint(mask))+1, func(location int) bool {
+		return mask&(1<<uint(location-1)) != 0
+	})
+}
+
+// allows reports whether route meets every constraint.
+func (order routeOrder) allows(route []int) bool {
+	visited := make(map[int]bool)
+	for i, stop := range route {
+		if !order.canVisit(stop, i+1, func(location int) bool { return visited[location] }) {
+			return false
+		}
+		visited[stop] = true
+	}
+	return true
+}
+
+// ancestors lists every location that must be visited before location, directly
+// or through other constraints.
+func (order routeOrder) ancestors(location int) map[int]bool {
+	found := make(map[int]bool)
+	pending := append([]int(nil), order.predecessors[location]...)
+	for len(pending) > 0 {
+		next := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if !found[next] {
+			found[next] = true
+			pending = append(pending, order.predecessors[next]...)
+		}
+	}
+	return found
+}
+
+// parseRouteOrder validates the ordering constraints of a trip request against its
+// stops, stopIDs[k] being location k+1 of the matrix. Rules that always hold, like a
+// stop coming after the start, are dropped.
+func parseRouteOrder(rules []precedenceRule, pins []pinnedStop, startID string, endingID string, stopIDs []string) (routeOrder, error) {
+	order := routeOrder{predecessors: make(map[int][]int), pinned: make(map[int]int), positions: make(map[int]int)}
+	index := make(map[string]int)
+	for k, stopID := range stopIDs {
+		index[stopID] = k + 1
+	}
+
+	for _, rule := range rules {
+		if rule.Before == startID || (len(endingID) > 0 && rule.After == endingID) {
+			continue
+		}
+		before, okBefore := index[rule.Before]
+		after, okAfter := index[rule.After]
+		if !okBefore || !okAfter || before == after {
+			return routeOrder{}, badRequest("invalid_constraint", "before and after must name two different stops of the trip", rule)
+		}
+		order.predecessors[after] = append(order.predecessors[after], before)
+	}
+
+	for _, pin := range pins {
+		location, ok := index[pin.LocationID]
+		if !ok {
+			return routeOrder{}, badRequest("invalid_constraint", "Only the stops of the trip can be pinned", pin)
+		}
+		if pin.Position < 1 || pin.Position > len(stopIDs) {
+			return routeOrder{}, badRequest("invalid_constraint", "position must be between 1 and the number of stops", pin)
+		}
+		_, pinnedTwice := order.pinned[location]
+		_, positionTaken := order.positions[pin.Position]
+		if pinnedTwice || positionTaken {
+			return routeOrder{}, badRequest("invalid_constraint", "A stop can only be pinned once and a position only hold one stop", pin)
+		}
+		order.pinned[location], order.positions[pin.Position] = pin.Position, location
+	}
+
+	if cycle := order.cycle(); cycle != nil {
+		cycleIDs := make([]string, len(cycle))
+		for i, location := range cycle {
+			cycleIDs[i] = stopIDs[location-1]
+		}
+		return routeOrder{}, badRequest("cyclic_constraints", "The precedence rules form a cycle", map[string][]string{"cycle": cycleIDs})
+	}
+	return order, nil
+}
+
+// cycle finds a cycle of precedence rules, listed in the order the rules ask for and
+// ending where it started, or returns nil.
+func (order routeOrder) cycle() []int {
+	const (
+		unvisited = iota
+		onPath
+		done
+	)
+	state := make(map[int]int)
+	var path []int
+	var visit func(location int) []int
+	visit = func(location int) []int {
+		state[location] = onPath
+		path = append(path, location)
+		for _, before := range order.predecessors[location] {
+			switch state[before] {
+			case onPath:
+				//path runs from each location to one that must precede it
+				start := len(path) - 1
+				for path[start] != before {
+					start--
+				}
+				cycle := []int{before}
+				for i := len(path) - 1; i >= start; i-- {
+					cycle = append(cycle, path[i])
+				}
+				return cycle
+			case unvisited:
+				if cycle := visit(before); cycle != nil {
+					return cycle
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		state[location] = done
+		return nil
+	}
+
+	locations := make([]int, 0, len(order.predecessors))
+	for location := range order.predecessors {
+		locations = append(locations, location)
+	}
+	sort.Ints(locations)
+	for _, location := range locations {
+		if state[location] == unvisited {
+			if cycle := visit(location); cycle != nil {
+				return cycle
+			}
+		}
+	}
+	return nil
+}
+
+// orderedNearest is getCoordinates for matrices with ordering constraints. It moves
+// to the nearest stop the constraints allow next, favouring the stops the next pinned
+// stop waits for, and returns nil when it gets stuck.
+func orderedNearest(matrix costMatrix, stops []int) []int {
+	order := matrix.order
+	visited := make(map[int]bool)
+	isVisited := func(location int) bool { return visited[location] }
+	route := make([]int, 0, len(stops))
+	previous := 0
+	for position := 1; position <= len(stops); position++ {
+		var candidates []int
+		for _, stop := range stops {
+			if !visited[stop] && order.canVisit(stop, position, isVisited) {
+				candidates = append(candidates, stop)
+			}
+		}
+		if _, ok := order.positions[position]; !ok {
+			candidates = waitedFor(order, candidates, position, visited)
+		}
+		if len(candidates) == 0 {
+			return nil
+		}
+
+		nearest := candidates[0]
+		for _, candidate := range candidates[1:] {
+			current, best := matrix.weight(previous, candidate), matrix.weight(previous, nearest)
+			if current < best || (current == best && matrix.legs[previous][candidate].Distance < matrix.legs[previous][nearest].Distance) {
+				nearest = candidate
+			}
+		}
+		route = append(route, nearest)
+		visited[nearest] = true
+		previous = nearest
+	}
+	return route
+}
+
+// feasibleOrder orders the stops by the precedence rules and pins alone and returns
+// nil only when no order meets them. Each stop gets a release, the first position it
+// may take, and a deadline, the last, both tightened along the rules. Filling the
+// positions in turn with the released stop of earliest deadline then meets every
+// deadline whenever some order does, as every stop takes exactly one position.
+func (order routeOrder) feasibleOrder(stops []int) []int {
+	n := len(stops)
+	release, deadline := make(map[int]int), make(map[int]int)
+	for _, stop := range stops {
+		release[stop], deadline[stop] = 1, n
+		if position, ok := order.pinned[stop]; ok {
+			release[stop], deadline[stop] = position, position
+		}
+	}
+	//The rules have no cycle, so no chain is longer than n and n rounds settle the bounds
+	for round := 0; round < n; round++ {
+		for _, stop := range stops {
+			for _, before := range order.predecessors[stop] {
+				if release[before]+1 > release[stop] {
+					release[stop] = release[before] + 1
+				}
+				if deadline[stop]-1 < deadline[before] {
+					deadline[before] = deadline[stop] - 1
+				}
+			}
+		}
+	}
+
+	visited := make(map[int]bool)
+	isVisited := func(location int) bool { return visited[location] }
+	route := make([]int, 0, n)
+	for position := 1; position <= n; position++ {
+		next := 0
+		for _, stop := range stops {
+			if visited[stop] || release[stop] > position || !order.canVisit(stop, position, isVisited) {
+				continue
+			}
+			if next == 0 || deadline[stop] < deadline[next] {
+				next = stop
+			}
+		}
+		if next == 0 || deadline[next] < position {
+			return nil
+		}
+		route = append(route, next)
+		visited[next] = true
+	}
+	return route
+}
+
+// waitedFor narrows candidates to the ones the first pinned stop after position still
+// waits for, if any, so that they are all placed before its position comes up.
+func waitedFor(order routeOrder, candidates []int, position int, visited map[int]bool) []int {
+	next := 0
+	for pinnedPosition, location := range order.positions {
+		if pinnedPosition > position && !visited[location] && (next == 0 || pinnedPosition < order.pinned[next]) {
+			next = location
+		}
+	}
+	if next == 0 {
+		return candidates
+	}
+	ancestors := order.ancestors(next)
+	var waiting []int
+	for _, candidate := range candidates {
+		if ancestors[candidate] {
+			waiting = append(waiting, candidate)
+		}
+	}
+	if len(waiting) == 0 {
+		return candidates
+	}
+	return waiting
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// randomOrder draws a few precedence rules that follow a random order of the stops,
+// so they never form a cycle, and pins some stops anywhere, so they may conflict.
+func randomOrder(r *rand.Rand, stops int) routeOrder {
+	order := routeOrder{predecessors: make(map[int][]int), pinned: make(map[int]int), positions: make(map[int]int)}
+	ranks := r.Perm(stops)
+	for rule := r.Intn(stops + 1); rule > 0; rule-- {
+		before, after := r.Intn(stops)+1, r.Intn(stops)+1
+		if ranks[before-1] < ranks[after-1] {
+			order.predecessors[after] = append(order.predecessors[after], before)
+		}
+	}
+	for pin := r.Intn(3); pin > 0; pin-- {
+		location, position := r.Intn(stops)+1, r.Intn(stops)+1
+		_, pinned := order.pinned[location]
+		_, taken := order.positions[position]
+		if !pinned && !taken {
+			order.pinned[location], order.positions[position] = position, location
+		}
+	}
+	return order
+}
+
+func TestParseRouteOrder(t *testing.T) {
+	stopIDs := []string{"a", "b", "c", "d"}
+	tests := []struct {
+		name     string
+		rules    []precedenceRule
+		pins     []pinnedStop
+		endingID string
+		//want lists the predecessors of every stop with some
+		want      map[int][]int
+		wantPins  map[int]int
+		wantErr   string
+		wantCycle []string
+	}{
+		{name: "none", want: map[int][]int{}},
+		{name: "rules", rules: []precedenceRule{{"a", "b"}, {"c", "b"}, {"b", "d"}}, want: map[int][]int{2: {1, 3}, 4: {2}}},
+		{name: "start and end rules always hold", rules: []precedenceRule{{"start", "a"}, {"b", "end"}}, endingID: "end", want: map[int][]int{}},
+		{name: "pins", pins: []pinnedStop{{"d", 1}, {"a", 4}}, want: map[int][]int{}, wantPins: map[int]int{4: 1, 1: 4}},
+		{name: "unknown stop", rules: []precedenceRule{{"a", "x"}}, wantErr: "invalid_constraint"},
+		{name: "same stop", rules: []precedenceRule{{"a", "a"}}, wantErr: "invalid_constraint"},
+		{name: "end without an ending", rules: []precedenceRule{{"a", "end"}}, wantErr: "invalid_constraint"},
+		{name: "pin of the start", pins: []pinnedStop{{"start", 1}}, wantErr: "invalid_constraint"},
+		{name: "pin out of range", pins: []pinnedStop{{"a", 5}}, wantErr: "invalid_constraint"},
+		{name: "pinned twice", pins: []pinnedStop{{"a", 1}, {"a", 2}}, wantErr: "invalid_constraint"},
+		{name: "position taken", pins: []pinnedStop{{"a", 2}, {"b", 2}}, wantErr: "invalid_constraint"},
+		{name: "cycle", rules: []precedenceRule{{"a", "b"}, {"b", "c"}, {"c", "a"}, {"c", "d"}}, wantErr: "cyclic_constraints", wantCycle: []string{"a", "b", "c", "a"}},
+		{name: "two stop cycle", rules: []precedenceRule{{"d", "c"}, {"c", "d"}}, wantErr: "cyclic_constraints", wantCycle: []string{"c", "d", "c"}},
+	}
+	for _, test := range tests {
+		order, err := parseRouteOrder(test.rules, test.pins, "start", test.endingID, stopIDs)
+		if len(test.wantErr) > 0 {
+			apiErr, ok := err.(*apiError)
+			if !ok || apiErr.Status != http.StatusBadRequest || apiErr.Code != test.wantErr {
+				t.Errorf("%s: got error %v, want %s", test.name, err, test.wantErr)
+				continue
+			}
+			if test.wantCycle != nil {
+				cycle := apiErr.Details.(map[string][]string)["cycle"]
+				if len(cycle) != len(test.wantCycle) {
+					t.Errorf("%s: got cycle %v, want %v", test.name, cycle, test.wantCycle)
+					continue
+				}
+				for i := range cycle {
+					if cycle[i] != test.wantCycle[i] {
+						t.Errorf("%s: got cycle %v, want %v", test.name, cycle, test.wantCycle)
+						break
+					}
+				}
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if len(order.predecessors) != len(test.want) {
+			t.Errorf("%s: got predecessors %v, want %v", test.name, order.predecessors, test.want)
+		}
+		for location, predecessors := range test.want {
+			if len(order.predecessors[location]) != len(predecessors) {
+				t.Errorf("%s: got predecessors %v for %d, want %v", test.name, order.predecessors[location], location, predecessors)
+				continue
+			}
+			for i := range predecessors {
+				if order.predecessors[location][i] != predecessors[i] {
+					t.Errorf("%s: got predecessors %v for %d, want %v", test.name, order.predecessors[location], location, predecessors)
+					break
+				}
+			}
+		}
+		if len(order.pinned) != len(test.wantPins) {
+			t.Errorf("%s: got pins %v, want %v", test.name, order.pinned, test.wantPins)
+		}
+		for location, position := range test.wantPins {
+			if order.pinned[location] != position || order.positions[position] != location {
+				t.Errorf("%s: location %d is pinned at %d, want %d", test.name, location, order.pinned[location], position)
+			}
+		}
+	}
+}
+
+func TestRouteOrderCycle(t *testing.T) {
+	tests := []struct {
+		name         string
+		predecessors map[int][]int
+		want         []int
+	}{
+		{"no rules", nil, nil},
+		{"chain", map[int][]int{2: {1}, 3: {2}, 4: {3}}, nil},
+		{"diamond", map[int][]int{2: {1}, 3: {1}, 4: {2, 3}}, nil},
+		//1 comes before 2, 2 before 3 and 3 before 1
+		{"triangle", map[int][]int{1: {3}, 2: {1}, 3: {2}}, []int{1, 2, 3, 1}},
+		{"behind a chain", map[int][]int{1: {2}, 2: {3}, 3: {4}, 4: {3}}, []int{3, 4, 3}},
+	}
+	for _, test := range tests {
+		cycle := routeOrder{predecessors: test.predecessors}.cycle()
+		if len(cycle) != len(test.want) {
+			t.Errorf("%s: got cycle %v, want %v", test.name, cycle, test.want)
+			continue
+		}
+		for i := range cycle {
+			if cycle[i] != test.want[i] {
+				t.Errorf("%s: got cycle %v, want %v", test.name, cycle, test.want)
+				break
+			}
+		}
+	}
+}
+
+func TestRouteOrderCanFollow(t *testing.T) {
+	//3 must follow 1, 2 is pinned first and 4 third
+	order := routeOrder{
+		predecessors: map[int][]int{3: {1}},
+		pinned:       map[int]int{2: 1, 4: 3},
+		positions:    map[int]int{1: 2, 3: 4},
+	}
+	tests := []struct {
+		name string
+		mask int
+		next int
+		want bool
+	}{
+		{"pinned stop at its position", 0, 2, true},
+		{"free stop at a pinned position", 0, 1, false},
+		{"free stop at a free position", 1 << 1, 1, true},
+		{"pinned stop too early", 1 << 1, 4, false},
+		{"pinned stop too late", 1<<1 | 1<<0 | 1<<3, 4, false},
+		{"predecessor not visited", 1 << 1, 3, false},
+		{"predecessor visited", 1<<1 | 1<<0 | 1<<3, 3, true},
+		{"pinned stop after its predecessors", 1<<1 | 1<<0, 4, true},
+		{"free stop at the pinned position", 1<<1 | 1<<0, 3, false},
+	}
+	for _, test := range tests {
+		if got := order.canFollow(test.mask, test.next); got != test.want {
+			t.Errorf("%s: canFollow(%b, %d) = %v, want %v", test.name, test.mask, test.next, got, test.want)
+		}
+	}
+	if !order.allows([]int{2, 1, 4, 3}) || order.allows([]int{2, 3, 4, 1}) || order.allows([]int{1, 2, 4, 3}) {
+		t.Error("allows disagrees with canFollow")
+	}
+}
+
+func TestFeasibleOrderFindsAnOrderWheneverOneExists(t *testing.T) {
+	r := rand.New(rand.NewSource(13))
+	feasible, infeasible := 0, 0
+	for trial := 0; trial < 400; trial++ {
+		stops := r.Intn(6) + 1
+		order := randomOrder(r, stops)
+		all := make([]int, stops)
+		for i := range all {
+			all[i] = i + 1
+		}
+		exists := false
+		permutations(all, func(route []int) {
+			exists = exists || order.allows(route)
+		})
+
+		route := order.feasibleOrder(all)
+		if !exists {
+			infeasible++
+			if route != nil {
+				t.Fatalf("feasibleOrder found %v for %+v, no order meets it", route, order)
+			}
+			continue
+		}
+		feasible++
+		if route == nil || len(route) != stops || !order.allows(route) {
+			t.Fatalf("feasibleOrder returned %v for %+v", route, order)
+		}
+	}
+	if feasible == 0 || infeasible == 0 {
+		t.Errorf("the random constraints gave %d feasible and %d infeasible trips, want both", feasible, infeasible)
+	}
+}
+
+func TestPlannersFollowOrder(t *testing.T) {
+	defer func(maxExact int, budget time.Duration) {
+		config.MaxExactStops, config.LocalSearchBudget = maxExact, budget
+	}(config.MaxExactStops, config.LocalSearchBudget)
+	config.LocalSearchBudget = time.Second
+
+	r := rand.New(rand.NewSource(17))
+	for trial := 0; trial < 100; trial++ {
+		matrix := randomMatrix(r, 6, 0)
+		matrix.order = randomOrder(r, 6)
+		want := bruteForceWeight(matrix, matrix.order.allows)
+
+		route, ok := solveExactTour(matrix)
+		if ok != !math.IsInf(want, 1) {
+			t.Fatalf("solveExactTour reported %v for %+v, the best allowed order weighs %v", ok, matrix.order, want)
+		}
+		if ok && tourWeight(matrix, route) != want {
+			t.Errorf("solveExactTour returned %v weighing %v, the best allowed order weighs %v", route, tourWeight(matrix, route), want)
+		}
+
+		//The heuristics find some allowed order whenever there is one
+		config.MaxExactStops = 0
+		plan := optimizeRoute(matrix)
+		if !sameStops(matrix, plan.Route) || matrix.order.allows(plan.Route) != ok {
+			t.Errorf("optimizeRoute returned %v for %+v", plan.Route, matrix.order)
+		}
+	}
+}
+
+func TestPlanTripWithOrder(t *testing.T) {
+	server, stop := newTestServer(t)
+	defer stop()
+	start := addTestLocation(t, server, "Office", "94105")
+	client := addTestLocation(t, server, "Client", "95112")
+	lab := addTestLocation(t, server, "Lab", "94301")
+	warehouse := addTestLocation(t, server, "Warehouse", "94607")
+
+	tests := []struct {
+		name       string
+		precedence []precedenceRule
+		pinned     []pinnedStop
+		wantStatus int
+		wantCode   string
+		want       []string
+	}{
+		{"client before warehouse", []precedenceRule{{client, warehouse}}, nil, http.StatusCreated, "", []string{lab, client, warehouse}},
+		{"warehouse pinned last", nil, []pinnedStop{{warehouse, 3}}, http.StatusCreated, "", []string{lab, client, warehouse}},
+		{"client pinned first", []precedenceRule{{lab, warehouse}}, []pinnedStop{{client, 1}}, http.StatusCreated, "", []string{client, lab, warehouse}},
+		{"cycle", []precedenceRule{{client, lab}, {lab, client}}, nil, http.StatusBadRequest, "cyclic_constraints", nil},
+		{"pins against rules", []precedenceRule{{client, lab}}, []pinnedStop{{lab, 1}}, http.StatusUnprocessableEntity, "infeasible_constraints", nil},
+	}
+	for _, test := range tests {
+		request := UberPostRequest{StartingFromLocationID: start, LocationIds: []string{client, lab, warehouse}, Precedence: test.precedence, Pinned: test.pinned}
+		var trip struct {
+			UberResponse
+			Code string `json:"code"`
+		}
+		status := sendJSON(t, server, "POST", "/trips/", request, &trip)
+		if status != test.wantStatus || trip.Code != test.wantCode {
+			t.Fatalf("%s: got status %d and code %q, want %d and %q", test.name, status, trip.Code, test.wantStatus, test.wantCode)
+		}
+		for i := range test.want {
+			if trip.BestRouteLocationIds[i] != test.want[i] {
+				t.Errorf("%s: got route %v, want %v", test.name, trip.BestRouteLocationIds, test.want)
+				break
+			}
+		}
+	}
+}
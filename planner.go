@@ -0,0 +1,324 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+const planningMethodExact string = "exact"
+const planningMethodGreedy string = "greedy"
+const planningMethodLocalSearch string = "greedy+local_search"
+
+// legEstimate is the Uber estimate for travelling from one trip location to another.
+// Cost is the low end of the price range in minor units, which the planner minimizes.
+type legEstimate struct {
+	Cost      int64
+	Duration  int
+	Distance  float64
+	ProductID string
+	//The price range as quoted, in units of Currency, and as displayed by Uber
+	LowEstimate     float64
+	HighEstimate    float64
+	Minimum         float64
+	Estimate        string
+	Currency        string
+	SurgeMultiplier float64
+}
+
+// noRouteEnd marks an open route, which finishes at its last stop.
+const noRouteEnd int = -1
+
+// costMatrix holds the estimate of every ordered pair of trip locations and the
+// weight of each leg under the trip objective.
+// Index 0 is always the starting location, the stops follow in request order and a
+// fixed destination comes last.
+type costMatrix struct {
+	locations []locationStruct
+	legs      [][]legEstimate
+	weights   [][]float64
+	//end is where the route goes after its stops: 0 for a round trip, the last
+	//location for a fixed destination or noRouteEnd
+	end int
+	//windows holds the arrival windows and dwell times of the locations that have them
+	windows map[int]stopWindow
+	order   routeOrder
+}
+
+// applyObjective computes the leg weights. A weighted objective first scales every
+// metric by its mean over the matrix so the weights express relative importance.
+func (matrix *costMatrix) applyObjective(objective tripObjective) {
+	costScale, durScale, distScale := 1.0, 1.0, 1.0
+	if objective.Name == objectiveWeighted {
+		var costSum, durSum, distSum float64
+		for i := range matrix.legs {
+			for j := range matrix.legs[i] {
+				costSum += float64(matrix.legs[i][j].Cost)
+				durSum += float64(matrix.legs[i][j].Duration)
+				distSum += matrix.legs[i][j].Distance
+			}
+		}
+		costScale, durScale, distScale = meanScale(costSum, len(matrix.legs)), meanScale(durSum, len(matrix.legs)), meanScale(distSum, len(matrix.legs))
+	}
+
+	matrix.weights = make([][]float64, len(matrix.legs))
+	for i := range matrix.legs {
+		matrix.weights[i] = make([]float64, len(matrix.legs))
+		for j, leg := range matrix.legs[i] {
+			matrix.weights[i][j] = objective.Weights.Cost*float64(leg.Cost)/costScale +
+				objective.Weights.Duration*float64(leg.Duration)/durScale +
+				objective.Weights.Distance*leg.Distance/distScale
+		}
+	}
+}
+
+// meanScale is the mean of the n*(n-1) off-diagonal entries summing to sum, or 1
+// when there is nothing to scale by.
+func meanScale(sum float64, n int) float64 {
+	if n < 2 || sum <= 0 {
+		return 1
+	}
+	return sum / float64(n*(n-1))
+}
+
+func (matrix costMatrix) weight(from int, to int) float64 {
+	return matrix.weights[from][to]
+}
+
+// closingWeight is the weight of the leg from the last stop to the end of the route.
+func (matrix costMatrix) closingWeight(last int) float64 {
+	if matrix.end == noRouteEnd {
+		return 0
+	}
+	return matrix.weight(last, matrix.end)
+}
+
+// closingDistance is the distance of the leg from the last stop to the end of the route.
+func (matrix costMatrix) closingDistance(last int) float64 {
+	if matrix.end == noRouteEnd {
+		return 0
+	}
+	return matrix.legs[last][matrix.end].Distance
+}
+
+// stops lists the locations the route orders, which are all but the start and a
+// fixed destination.
+func (matrix costMatrix) stops() []int {
+	last := len(matrix.locations) - 1
+	if matrix.end > 0 {
+		last--
+	}
+	stops := make([]int, 0, last)
+	for i := 1; i <= last; i++ {
+		stops = append(stops, i)
+	}
+	return stops
+}
+
+// routeTotals sums the legs of 0 -> route... -> end.
+func (matrix costMatrix) routeTotals(route []int) (int64, int, float64) {
+	var totalCost int64
+	var totalDur int
+	var totalDist float64
+	previous := 0
+	for i := 0; i <= len(route); i++ {
+		next := matrix.end
+		if i < len(route) {
+			next = route[i]
+		} else if next == noRouteEnd {
+			break
+		}
+		leg := matrix.legs[previous][next]
+		totalCost += leg.Cost
+		totalDur += leg.Duration
+		totalDist += leg.Distance
+		previous = next
+	}
+	return totalCost, totalDur, totalDist
+}
+
+// routeLegs lists the legs of 0 -> route... -> end with their estimates.
+func (matrix costMatrix) routeLegs(route []int) []tripLeg {
+	visits := matrix.visits(route)
+	legs := make([]tripLeg, len(visits))
+	previous := 0
+	for i, next := range visits {
+		leg := matrix.legs[previous][next]
+		legs[i] = tripLeg{
+			FromLocationID:  matrix.locations[previous].ID.Hex(),
+			ToLocationID:    matrix.locations[next].ID.Hex(),
+			ProductID:       leg.ProductID,
+			LowEstimate:     leg.LowEstimate,
+			HighEstimate:    leg.HighEstimate,
+			Minimum:         leg.Minimum,
+			Estimate:        leg.Estimate,
+			CurrencyCode:    leg.Currency,
+			SurgeMultiplier: leg.SurgeMultiplier,
+			Distance:        leg.Distance,
+			Duration:        leg.Duration,
+		}
+		previous = next
+	}
+	return legs
+}
+
+// routePlan is the ordering chosen for the stops of a cost matrix.
+type routePlan struct {
+	Route  []int
+	Method string
+	//Low estimates of the greedy route before and after local search in minor units,
+	//and their weights under the objective of the matrix, which local search
+	//minimizes and which include the lateness penalty, heuristic plans only
+	GreedyCost     int64
+	ImprovedCost   int64
+	GreedyWeight   float64
+	ImprovedWeight float64
+	//Exhaustive is set when the exact solver tried every order, so a route that
+	//breaks the constraints proves that no route meets them
+	Exhaustive bool
+}
+
+// optimizeRoute orders the stops of the matrix, solving exactly when the trip is
+// small enough and otherwise improving the greedy getCoordinates route with local
+// search for at most config.LocalSearchBudget.
+func optimizeRoute(matrix costMatrix) routePlan {
+	stops := matrix.stops()
+	exactStops := config.MaxExactStops
+	if exactStops > maxExactStopsLimit {
+		exactStops = maxExactStopsLimit
+	}
+	if len(stops) <= exactStops {
+		solve := solveExactTour
+		if len(matrix.windows) > 0 {
+			solve = solveExactWindows
+		}
+		if route, ok := solve(matrix); ok {
+			return routePlan{Route: route, Method: planningMethodExact, Exhaustive: true}
+		}
+		//No route meets every constraint, look for the least late one to explain why
+	}
+	exhaustive := len(stops) <= exactStops
+
+	greedy := getCoordinates(matrix, 0, stops, make([]int, 0, len(stops)))
+	if !matrix.order.isEmpty() {
+		//orderedNearest may get stuck on a satisfiable trip, feasibleOrder never does
+		if ordered := orderedNearest(matrix, stops); ordered != nil {
+			greedy = ordered
+		} else if ordered := matrix.order.feasibleOrder(stops); ordered != nil {
+			greedy = ordered
+		}
+	}
+	if len(matrix.windows) > 0 {
+		if byDeadline := matrix.deadlineOrder(stops); tourWeight(matrix, byDeadline) < tourWeight(matrix, greedy) {
+			greedy = byDeadline
+		}
+	}
+	plan := routePlan{Route: greedy, Method: planningMethodGreedy, Exhaustive: exhaustive}
+	plan.GreedyCost, plan.GreedyWeight = matrix.routePrice(plan.Route).Low, tourWeight(matrix, plan.Route)
+	plan.ImprovedCost, plan.ImprovedWeight = plan.GreedyCost, plan.GreedyWeight
+	if config.LocalSearchBudget > 0 {
+		plan.Route = improveRoute(matrix, plan.Route, time.Now().Add(config.LocalSearchBudget))
+		plan.Method = planningMethodLocalSearch
+		plan.ImprovedCost, plan.ImprovedWeight = matrix.routePrice(plan.Route).Low, tourWeight(matrix, plan.Route)
+	}
+	return plan
+}
+
+// solveExactTour finds the cheapest route from location 0 through every stop to the
+// end of the matrix using dynamic programming over subsets of stops (Held-Karp).
+// It reports false when no route meets the ordering constraints.
+func solveExactTour(matrix costMatrix) ([]int, bool) {
+	n := len(matrix.stops())
+	if n == 0 {
+		return []int{}, true
+	}
+	full := 1<<uint(n) - 1
+	//best[mask][j] is the cheapest path from the start visiting the stops in mask and ending at stop j+1,
+	//distance[mask][j] its length, which breaks ties between paths of equal weight like getCoordinates
+	best := make([][]float64, full+1)
+	distance := make([][]float64, full+1)
+	parent := make([][]int, full+1)
+	for mask := range best {
+		best[mask] = make([]float64, n)
+		distance[mask] = make([]float64, n)
+		parent[mask] = make([]int, n)
+		for j := range best[mask] {
+			best[mask][j] = math.Inf(1)
+			parent[mask][j] = -1
+		}
+	}
+	for j := 0; j < n; j++ {
+		if matrix.order.canFollow(0, j+1) {
+			best[1<<uint(j)][j] = matrix.weight(0, j+1)
+			distance[1<<uint(j)][j] = matrix.legs[0][j+1].Distance
+		}
+	}
+
+	for mask := 1; mask <= full; mask++ {
+		for last := 0; last < n; last++ {
+			if mask&(1<<uint(last)) == 0 || math.IsInf(best[mask][last], 1) {
+				continue
+			}
+			for next := 0; next < n; next++ {
+				if mask&(1<<uint(next)) != 0 || !matrix.order.canFollow(mask, next+1) {
+					continue
+				}
+				nextMask := mask | 1<<uint(next)
+				cost := best[mask][last] + matrix.weight(last+1, next+1)
+				length := distance[mask][last] + matrix.legs[last+1][next+1].Distance
+				if cost < best[nextMask][next] || (cost == best[nextMask][next] && length < distance[nextMask][next]) {
+					best[nextMask][next] = cost
+					distance[nextMask][next] = length
+					parent[nextMask][next] = last
+				}
+			}
+		}
+	}
+
+	//Close the route at its end and walk the parents backwards
+	last := 0
+	for j := 1; j < n; j++ {
+		current, cheapest := best[full][j]+matrix.closingWeight(j+1), best[full][last]+matrix.closingWeight(last+1)
+		if current < cheapest || (current == cheapest && distance[full][j]+matrix.closingDistance(j+1) < distance[full][last]+matrix.closingDistance(last+1)) {
+			last = j
+		}
+	}
+	if math.IsInf(best[full][last], 1) {
+		return nil, false
+	}
+	route := make([]int, n)
+	mask := full
+	for position := n - 1; position >= 0; position-- {
+		route[position] = last + 1
+		previous := parent[mask][last]
+		mask &^= 1 << uint(last)
+		last = previous
+	}
+	return route, true
+}
+
+// getCoordinates builds the route greedily, always moving to the remaining stop with
+// the lowest weight under the trip objective and breaking ties on distance.
+func getCoordinates(matrix costMatrix, start int, input []int, output []int) []int {
+
+	if len(input) == 0 {
+		return output
+	}
+	// Find the nearest location from start location
+	min := 0
+	for i := 1; i < len(input); i++ {
+		current, nearest := matrix.weight(start, input[i]), matrix.weight(start, input[min])
+		if current < nearest || (current == nearest && matrix.legs[start][input[i]].Distance < matrix.legs[start][input[min]].Distance) {
+			min = i
+		}
+	}
+
+	//Consider this location as the start location
+	nearestLocation := input[min]
+
+	//Remove it from input slice and append it to the output slice
+	output = append(output, nearestLocation)
+	input = append(input[:min:min], input[min+1:]...)
+
+	//Recursively call this function until the input slice is empty
+	return getCoordinates(matrix, nearestLocation, input, output)
+}
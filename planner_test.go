@@ -0,0 +1,187 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// randomMatrix builds a cost matrix of stops random stops priced in dollars, with a
+// fixed destination after them when end is not 0 or noRouteEnd, weighted by cost.
+func randomMatrix(r *rand.Rand, stops int, end int) costMatrix {
+	size := stops + 1
+	if end > 0 {
+		size++
+		end = size - 1
+	}
+	matrix := costMatrix{locations: make([]locationStruct, size), legs: make([][]legEstimate, size), end: end}
+	for i := range matrix.legs {
+		matrix.legs[i] = make([]legEstimate, size)
+		for j := range matrix.legs[i] {
+			if i != j {
+				low := float64(r.Intn(4000)+100) / 100
+				matrix.legs[i][j] = legEstimate{Cost: toMinorUnits(low, "USD"), LowEstimate: low, HighEstimate: low + 2, Currency: "USD",
+					Duration: r.Intn(1800) + 60, Distance: float64(r.Intn(200)) / 10}
+			}
+		}
+	}
+	matrix.applyObjective(tripObjective{Name: objectiveCheapest, Weights: ObjectiveWeights{Cost: 1}})
+	return matrix
+}
+
+// permutations calls visit with every order of stops.
+func permutations(stops []int, visit func([]int)) {
+	route := append([]int(nil), stops...)
+	var permute func(k int)
+	permute = func(k int) {
+		if k == len(route) {
+			visit(route)
+			return
+		}
+		for i := k; i < len(route); i++ {
+			route[k], route[i] = route[i], route[k]
+			permute(k + 1)
+			route[k], route[i] = route[i], route[k]
+		}
+	}
+	permute(0)
+}
+
+// bruteForceWeight is the lowest tourWeight over every order of the stops of matrix
+// that allowed accepts, +Inf when it accepts none.
+func bruteForceWeight(matrix costMatrix, allowed func([]int) bool) float64 {
+	best := math.Inf(1)
+	permutations(matrix.stops(), func(route []int) {
+		if weight := tourWeight(matrix, route); weight < best && allowed(route) {
+			best = weight
+		}
+	})
+	return best
+}
+
+func anyRoute([]int) bool { return true }
+
+// sameStops reports whether route visits every stop of matrix exactly once.
+func sameStops(matrix costMatrix, route []int) bool {
+	stops := matrix.stops()
+	if len(route) != len(stops) {
+		return false
+	}
+	seen := make(map[int]bool)
+	for _, stop := range route {
+		if stop < 1 || stop > len(stops) || seen[stop] {
+			return false
+		}
+		seen[stop] = true
+	}
+	return true
+}
+
+func TestSolveExactTourMatchesBruteForce(t *testing.T) {
+	tests := []struct {
+		name  string
+		stops int
+		end   int
+	}{
+		{"no stops", 0, 0},
+		{"one stop round trip", 1, 0},
+		{"round trip", 6, 0},
+		{"open route", 6, noRouteEnd},
+		{"fixed destination", 6, 1},
+		{"fixed destination without stops", 0, 1},
+	}
+	for _, test := range tests {
+		r := rand.New(rand.NewSource(int64(test.stops)*31 + int64(test.end)))
+		for trial := 0; trial < 20; trial++ {
+			matrix := randomMatrix(r, test.stops, test.end)
+			route, ok := solveExactTour(matrix)
+			if !ok || !sameStops(matrix, route) {
+				t.Fatalf("%s: solveExactTour returned %v, %v", test.name, route, ok)
+			}
+			if got, want := tourWeight(matrix, route), bruteForceWeight(matrix, anyRoute); got != want {
+				t.Errorf("%s: route %v weighs %v, the best order weighs %v", test.name, route, got, want)
+			}
+		}
+	}
+}
+
+func TestSolveExactTourBreaksTiesOnDistance(t *testing.T) {
+	tests := []struct {
+		name string
+		end  int
+		//distances[i][j] is the distance of the leg i -> j, every leg weighing the same
+		distances [][]float64
+		want      []int
+	}{
+		{"open route", noRouteEnd, [][]float64{{0, 5, 1, 9}, {9, 0, 9, 1}, {9, 1, 0, 9}, {9, 9, 9, 0}}, []int{2, 1, 3}},
+		{"round trip", 0, [][]float64{{0, 1, 9, 9}, {9, 0, 1, 9}, {9, 9, 0, 1}, {1, 9, 9, 0}}, []int{1, 2, 3}},
+		{"closing leg", 0, [][]float64{{0, 1, 1}, {9, 0, 1}, {1, 1, 0}}, []int{1, 2}},
+	}
+	for _, test := range tests {
+		matrix := costMatrix{locations: make([]locationStruct, len(test.distances)), legs: make([][]legEstimate, len(test.distances)), end: test.end}
+		for i, row := range test.distances {
+			matrix.legs[i] = make([]legEstimate, len(row))
+			for j, distance := range row {
+				matrix.legs[i][j] = legEstimate{Cost: 100, Distance: distance}
+			}
+		}
+		matrix.applyObjective(tripObjective{Name: objectiveCheapest, Weights: ObjectiveWeights{Cost: 1}})
+
+		route, ok := solveExactTour(matrix)
+		if !ok || len(route) != len(test.want) {
+			t.Fatalf("%s: solveExactTour returned %v, %v", test.name, route, ok)
+		}
+		for i := range route {
+			if route[i] != test.want[i] {
+				t.Errorf("%s: got route %v, want the shortest of the equal routes %v", test.name, route, test.want)
+				break
+			}
+		}
+	}
+}
+
+func TestOptimizeRouteFallsBackToHeuristics(t *testing.T) {
+	defer func(maxExact int, budget time.Duration) {
+		config.MaxExactStops, config.LocalSearchBudget = maxExact, budget
+	}(config.MaxExactStops, config.LocalSearchBudget)
+
+	tests := []struct {
+		name       string
+		maxExact   int
+		budget     time.Duration
+		wantMethod string
+	}{
+		{"exact", 8, 0, planningMethodExact},
+		{"greedy", 0, 0, planningMethodGreedy},
+		{"local search", 0, time.Second, planningMethodLocalSearch},
+	}
+	for _, test := range tests {
+		config.MaxExactStops, config.LocalSearchBudget = test.maxExact, test.budget
+		matrix := randomMatrix(rand.New(rand.NewSource(3)), 7, 0)
+		plan := optimizeRoute(matrix)
+		if plan.Method != test.wantMethod || !sameStops(matrix, plan.Route) {
+			t.Fatalf("%s: got %s route %v", test.name, plan.Method, plan.Route)
+		}
+		if plan.ImprovedWeight > plan.GreedyWeight {
+			t.Errorf("%s: local search made the route heavier, %v after %v", test.name, plan.ImprovedWeight, plan.GreedyWeight)
+		}
+		if test.wantMethod != planningMethodExact && plan.ImprovedWeight != tourWeight(matrix, plan.Route) {
+			t.Errorf("%s: reported weight %v, the route weighs %v", test.name, plan.ImprovedWeight, tourWeight(matrix, plan.Route))
+		}
+	}
+}
+
+func TestOptimizeRouteClampsExactStops(t *testing.T) {
+	defer func(maxExact int, budget time.Duration) {
+		config.MaxExactStops, config.LocalSearchBudget = maxExact, budget
+	}(config.MaxExactStops, config.LocalSearchBudget)
+	config.MaxExactStops, config.LocalSearchBudget = 25, 0
+
+	//Solving 17 stops exactly would take tables of 2^17*17 entries
+	matrix := randomMatrix(rand.New(rand.NewSource(19)), maxExactStopsLimit+1, 0)
+	plan := optimizeRoute(matrix)
+	if plan.Method != planningMethodGreedy || plan.Exhaustive || !sameStops(matrix, plan.Route) {
+		t.Errorf("got %s route %v, exhaustive %v, want a greedy route", plan.Method, plan.Route, plan.Exhaustive)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// priceKey identifies a cached estimate by the coordinates of both ends and the product.
+type priceKey struct {
+	StartLat, StartLng float64
+	EndLat, EndLng     float64
+	Product            string
+}
+
+type cachedEstimate struct {
+	estimate legEstimate
+	expires  time.Time
+}
+
+// pendingEstimate is a fetch in progress that other callers of the same key wait on.
+type pendingEstimate struct {
+	done     chan struct{}
+	estimate legEstimate
+	err      error
+}
+
+// priceCache is a priceEstimator that remembers the estimates of next for ttl and
+// makes sure concurrent requests for the same key share one call. Failed fetches
+// are not cached.
+type priceCache struct {
+	mu        sync.Mutex
+	ttl       time.Duration
+	entries   map[priceKey]cachedEstimate
+	pending   map[priceKey]*pendingEstimate
+	lastSweep time.Time
+	next      priceEstimator
+}
+
+func newPriceCache(ttl time.Duration, next priceEstimator) *priceCache {
+	return &priceCache{
+		ttl:       ttl,
+		entries:   make(map[priceKey]cachedEstimate),
+		pending:   make(map[priceKey]*pendingEstimate),
+		lastSweep: time.Now(),
+		next:      next,
+	}
+}
+
+func newPriceKey(start locationStruct, end locationStruct, product string) priceKey {
+	return priceKey{start.Coordinate.Lat, start.Coordinate.Lng, end.Coordinate.Lat, end.Coordinate.Lng, product}
+}
+
+func (cache *priceCache) Estimate(start locationStruct, end locationStruct, product string) (legEstimate, error) {
+	key := newPriceKey(start, end, product)
+
+	cache.mu.Lock()
+	if entry, ok := cache.entries[key]; ok && time.Now().Before(entry.expires) {
+		cache.mu.Unlock()
+		return entry.estimate, nil
+	}
+	if call, ok := cache.pending[key]; ok {
+		cache.mu.Unlock()
+		<-call.done
+		return call.estimate, call.err
+	}
+	call := &pendingEstimate{done: make(chan struct{})}
+	cache.pending[key] = call
+	cache.mu.Unlock()
+
+	call.estimate, call.err = cache.next.Estimate(start, end, product)
+
+	cache.mu.Lock()
+	delete(cache.pending, key)
+	if call.err == nil && cache.ttl > 0 {
+		cache.entries[key] = cachedEstimate{estimate: call.estimate, expires: time.Now().Add(cache.ttl)}
+	}
+	cache.sweep()
+	cache.mu.Unlock()
+	close(call.done)
+	return call.estimate, call.err
+}
+
+// sweep drops expired entries at most once per ttl. The caller holds cache.mu.
+func (cache *priceCache) sweep() {
+	now := time.Now()
+	if now.Sub(cache.lastSweep) < cache.ttl {
+		return
+	}
+	for key, entry := range cache.entries {
+		if now.After(entry.expires) {
+			delete(cache.entries, key)
+		}
+	}
+	cache.lastSweep = now
+}
+
+// buildCostMatrix fetches the estimate of every ordered pair of locations from
+// pricer, running at most config.PriceFetchConcurrency fetches at a time. Pairs with
+// identical coordinates are only requested once.
+func buildCostMatrix(pricer priceEstimator, locations []locationStruct, objective tripObjective) (costMatrix, error) {
+	matrix := costMatrix{locations: locations, legs: make([][]legEstimate, len(locations))}
+	for i := range locations {
+		matrix.legs[i] = make([]legEstimate, len(locations))
+	}
+
+	type pair struct{ from, to int }
+	pairs := make(map[priceKey][]pair)
+	for i := range locations {
+		for j := range locations {
+			if i != j {
+				key := newPriceKey(locations[i], locations[j], config.UberProduct)
+				pairs[key] = append(pairs[key], pair{i, j})
+			}
+		}
+	}
+
+	concurrency := config.PriceFetchConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	slots := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	var errOnce sync.Once
+	var firstErr error
+	for _, samePairs := range pairs {
+		wg.Add(1)
+		go func(samePairs []pair) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			first := samePairs[0]
+			estimate, err := pricer.Estimate(locations[first.from], locations[first.to], config.UberProduct)
+			if err != nil {
+				errOnce.Do(func() { firstErr = err })
+				return
+			}
+			//Each goroutine owns distinct cells of the matrix
+			for _, p := range samePairs {
+				matrix.legs[p.from][p.to] = estimate
+			}
+		}(samePairs)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return costMatrix{}, upstreamError(config.PriceProvider, firstErr)
+	}
+	err := matrix.checkCurrencies()
+	if err != nil {
+		return costMatrix{}, err
+	}
+
+	matrix.applyObjective(objective)
+	return matrix, nil
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingEstimator quotes a fare from the latitudes of both ends, counts its calls
+// per key and the most calls it saw running at once.
+type countingEstimator struct {
+	mu          sync.Mutex
+	delay       time.Duration
+	fail        bool
+	calls       map[priceKey]int
+	running     int
+	mostRunning int
+}
+
+func newCountingEstimator(delay time.Duration) *countingEstimator {
+	return &countingEstimator{delay: delay, calls: make(map[priceKey]int)}
+}
+
+func (estimator *countingEstimator) Estimate(start locationStruct, end locationStruct, product string) (legEstimate, error) {
+	estimator.mu.Lock()
+	estimator.calls[newPriceKey(start, end, product)]++
+	estimator.running++
+	if estimator.running > estimator.mostRunning {
+		estimator.mostRunning = estimator.running
+	}
+	fail := estimator.fail
+	estimator.mu.Unlock()
+
+	time.Sleep(estimator.delay)
+
+	estimator.mu.Lock()
+	estimator.running--
+	estimator.mu.Unlock()
+	if fail {
+		return legEstimate{}, errors.New("no products available")
+	}
+	low := 5 + start.Coordinate.Lat + end.Coordinate.Lat
+	return legEstimate{Cost: toMinorUnits(low, "USD"), LowEstimate: low, HighEstimate: low + 2, Currency: "USD"}, nil
+}
+
+func (estimator *countingEstimator) totalCalls() int {
+	estimator.mu.Lock()
+	defer estimator.mu.Unlock()
+	total := 0
+	for _, calls := range estimator.calls {
+		total += calls
+	}
+	return total
+}
+
+// atLatitude is a location at lat on the prime meridian.
+func atLatitude(lat float64) locationStruct {
+	var location locationStruct
+	location.Coordinate.Lat = lat
+	return location
+}
+
+func TestPriceCacheReusesEstimates(t *testing.T) {
+	next := newCountingEstimator(0)
+	cache := newPriceCache(time.Hour, next)
+	a, b := atLatitude(1), atLatitude(2)
+
+	first, err := cache.Estimate(a, b, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := cache.Estimate(a, b, ""); again != first || next.totalCalls() != 1 {
+		t.Errorf("the second estimate %+v made %d calls, want %+v from one call", again, next.totalCalls(), first)
+	}
+	//The key covers the direction and the product
+	cache.Estimate(b, a, "")
+	cache.Estimate(a, b, "uberXL")
+	if next.totalCalls() != 3 {
+		t.Errorf("made %d calls for three distinct keys", next.totalCalls())
+	}
+}
+
+func TestPriceCacheExpiresEstimates(t *testing.T) {
+	next := newCountingEstimator(0)
+	cache := newPriceCache(10*time.Millisecond, next)
+	a, b := atLatitude(1), atLatitude(2)
+
+	cache.Estimate(a, b, "")
+	time.Sleep(20 * time.Millisecond)
+	//The fetch of another key sweeps the expired entry
+	cache.Estimate(b, a, "")
+	if len(cache.entries) != 1 {
+		t.Errorf("the cache holds %d entries, want 1", len(cache.entries))
+	}
+	cache.Estimate(a, b, "")
+	if next.calls[newPriceKey(a, b, "")] != 2 {
+		t.Errorf("made %d calls across the expiry, want 2", next.calls[newPriceKey(a, b, "")])
+	}
+
+	uncached := newCountingEstimator(0)
+	cache = newPriceCache(0, uncached)
+	cache.Estimate(a, b, "")
+	cache.Estimate(a, b, "")
+	if uncached.totalCalls() != 2 {
+		t.Errorf("a cache without a ttl made %d calls, want 2", uncached.totalCalls())
+	}
+}
+
+func TestPriceCacheDoesNotCacheFailures(t *testing.T) {
+	next := newCountingEstimator(0)
+	next.fail = true
+	cache := newPriceCache(time.Hour, next)
+	a, b := atLatitude(1), atLatitude(2)
+
+	if _, err := cache.Estimate(a, b, ""); err == nil {
+		t.Fatal("the failed fetch returned no error")
+	}
+	next.fail = false
+	if _, err := cache.Estimate(a, b, ""); err != nil || next.totalCalls() != 2 {
+		t.Errorf("the retry returned %v after %d calls", err, next.totalCalls())
+	}
+}
+
+func TestPriceCacheSharesConcurrentFetches(t *testing.T) {
+	next := newCountingEstimator(20 * time.Millisecond)
+	cache := newPriceCache(time.Hour, next)
+	a, b := atLatitude(1), atLatitude(2)
+
+	var wg sync.WaitGroup
+	estimates := make([]legEstimate, 10)
+	for i := range estimates {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			estimates[i], _ = cache.Estimate(a, b, "")
+		}(i)
+	}
+	wg.Wait()
+	if next.totalCalls() != 1 {
+		t.Errorf("concurrent requests made %d calls, want 1", next.totalCalls())
+	}
+	for i, estimate := range estimates {
+		if estimate != estimates[0] {
+			t.Errorf("request %d got %+v, want %+v", i, estimate, estimates[0])
+		}
+	}
+}
+
+func TestBuildCostMatrix(t *testing.T) {
+	defer func(concurrency int) { config.PriceFetchConcurrency = concurrency }(config.PriceFetchConcurrency)
+	config.PriceFetchConcurrency = 2
+
+	//The last two locations share their coordinates
+	locations := []locationStruct{atLatitude(1), atLatitude(2), atLatitude(3), atLatitude(3)}
+	next := newCountingEstimator(5 * time.Millisecond)
+	matrix, err := buildCostMatrix(next, locations, tripObjective{Name: objectiveCheapest, Weights: ObjectiveWeights{Cost: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	//Every ordered pair of the three distinct places, and the two at the same place
+	if next.totalCalls() != 7 {
+		t.Errorf("made %d calls, want 7", next.totalCalls())
+	}
+	for key, calls := range next.calls {
+		if calls != 1 {
+			t.Errorf("fetched %+v %d times", key, calls)
+		}
+	}
+	if next.mostRunning > 2 {
+		t.Errorf("ran %d fetches at once, the limit is 2", next.mostRunning)
+	}
+	for i := range locations {
+		for j := range locations {
+			want := legEstimate{}
+			if i != j {
+				want, _ = newCountingEstimator(0).Estimate(locations[i], locations[j], "")
+			}
+			if matrix.legs[i][j] != want {
+				t.Errorf("leg %d -> %d is %+v, want %+v", i, j, matrix.legs[i][j], want)
+			}
+		}
+	}
+	if matrix.weight(0, 1) != float64(matrix.legs[0][1].Cost) {
+		t.Errorf("leg 0 -> 1 weighs %v, want its cost %d", matrix.weight(0, 1), matrix.legs[0][1].Cost)
+	}
+}
+
+func TestBuildCostMatrixReportsUpstreamErrors(t *testing.T) {
+	next := newCountingEstimator(0)
+	next.fail = true
+	_, err := buildCostMatrix(next, []locationStruct{atLatitude(1), atLatitude(2)}, tripObjective{Name: objectiveCheapest, Weights: ObjectiveWeights{Cost: 1}})
+	apiErr, ok := err.(*apiError)
+	if !ok || apiErr.Status != http.StatusBadGateway || apiErr.Code != "upstream_error" {
+		t.Fatalf("got error %v, want upstream_error", err)
+	}
+	if service := apiErr.Details.(map[string]string)["service"]; service != config.PriceProvider {
+		t.Errorf("the error names %q, want %q", service, config.PriceProvider)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// priceEstimator quotes a ride between two locations for the given product ID or
+// display name, or for the first product offered when product is empty.
+type priceEstimator interface {
+	Estimate(start locationStruct, end locationStruct, product string) (legEstimate, error)
+}
+
+// pricer is the estimator used by the planner, chosen by config.PriceProvider and
+// wrapped in the price cache.
+var pricer priceEstimator = newPriceCache(config.PriceCacheTTL, newPriceEstimator(config))
+
+func newPriceEstimator(cfg serverConfig) priceEstimator {
+	if cfg.PriceProvider == "offline" {
+		return offlinePriceEstimator{rates: cfg.OfflineRates}
+	}
+	return uberPriceEstimator{requestURL: uberRequestURL, serverToken: cfg.UberServerToken, client: &http.Client{Timeout: uberRequestTimeout}}
+}
+
+// uberPriceEstimator uses the Uber v1 price estimates endpoint.
+type uberPriceEstimator struct {
+	requestURL  string
+	serverToken string
+	client      *http.Client
+}
+
+func (uber uberPriceEstimator) Estimate(start locationStruct, end locationStruct, product string) (legEstimate, error) {
+
+	uberURL := strings.Replace(uber.requestURL, startLatitude, strconv.FormatFloat(start.Coordinate.Lat, 'f', -1, 64), -1)
+	uberURL = strings.Replace(uberURL, startLongitude, strconv.FormatFloat(start.Coordinate.Lng, 'f', -1, 64), -1)
+	uberURL = strings.Replace(uberURL, endLatitude, strconv.FormatFloat(end.Coordinate.Lat, 'f', -1, 64), -1)
+	uberURL = strings.Replace(uberURL, endLongitude, strconv.FormatFloat(end.Coordinate.Lng, 'f', -1, 64), -1)
+	uberURL = strings.Replace(uberURL, serverToken, uber.serverToken, -1)
+
+	res, err := uber.client.Get(uberURL)
+	if err != nil {
+		return legEstimate{}, err
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return legEstimate{}, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return legEstimate{}, fmt.Errorf("Uber price estimate failed with %s: %s", res.Status, body)
+	}
+
+	var uberResult UberResults
+	err = json.Unmarshal(body, &uberResult)
+	if err != nil {
+		return legEstimate{}, err
+	}
+	for _, price := range uberResult.Prices {
+		if len(product) == 0 || price.ProductID == product || price.DisplayName == product {
+			return legEstimate{
+				Cost:            toMinorUnits(price.LowEstimate, price.CurrencyCode),
+				Duration:        price.Duration,
+				Distance:        price.Distance,
+				ProductID:       price.ProductID,
+				LowEstimate:     price.LowEstimate,
+				HighEstimate:    price.HighEstimate,
+				Minimum:         price.Minimum,
+				Estimate:        price.Estimate,
+				Currency:        price.CurrencyCode,
+				SurgeMultiplier: price.SurgeMultiplier,
+			}, nil
+		}
+	}
+	return legEstimate{}, fmt.Errorf("no Uber estimate for product %q from %s to %s", product, start.Name, end.Name)
+}
+
+// offlineRates prices an offline estimate: a base fare plus per mile and per minute
+// charges, never less than the minimum fare. Trips are assumed to drive at SpeedMph.
+type offlineRates struct {
+	BaseFare    float64
+	PerMile     float64
+	PerMinute   float64
+	MinimumFare float64
+	SpeedMph    float64
+}
+
+const offlineProductID string = "offline"
+const offlineCurrency string = "USD"
+
+// offlinePriceEstimator derives deterministic estimates from the great-circle distance
+// between two locations, for tests and demos without the Uber API.
+type offlinePriceEstimator struct {
+	rates offlineRates
+}
+
+func (offline offlinePriceEstimator) Estimate(start locationStruct, end locationStruct, product string) (legEstimate, error) {
+	if offline.rates.SpeedMph <= 0 {
+		return legEstimate{}, fmt.Errorf("offline speed must be positive, got %v", offline.rates.SpeedMph)
+	}
+	miles := haversineMiles(start.Coordinate.Lat, start.Coordinate.Lng, end.Coordinate.Lat, end.Coordinate.Lng)
+	minutes := miles / offline.rates.SpeedMph * 60
+	fare := math.Max(offline.rates.BaseFare+offline.rates.PerMile*miles+offline.rates.PerMinute*minutes, offline.rates.MinimumFare)
+	fare = math.Round(fare*100) / 100
+
+	return legEstimate{
+		Cost:            toMinorUnits(fare, offlineCurrency),
+		Duration:        int(math.Round(minutes * 60)),
+		Distance:        math.Round(miles*100) / 100,
+		ProductID:       offlineProductID,
+		LowEstimate:     fare,
+		HighEstimate:    fare,
+		Minimum:         offline.rates.MinimumFare,
+		Estimate:        formatMinorUnits(toMinorUnits(fare, offlineCurrency), offlineCurrency),
+		Currency:        offlineCurrency,
+		SurgeMultiplier: 1,
+	}, nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestOfflinePriceEstimator(t *testing.T) {
+	sanFrancisco, sanJose := locationStruct{Name: "San Francisco"}, locationStruct{Name: "San Jose"}
+	sanFrancisco.Coordinate.Lat, sanFrancisco.Coordinate.Lng = testZips["94105"].Lat, testZips["94105"].Lng
+	sanJose.Coordinate.Lat, sanJose.Coordinate.Lng = testZips["95112"].Lat, testZips["95112"].Lng
+
+	tests := []struct {
+		name     string
+		start    locationStruct
+		end      locationStruct
+		wantCost int64
+		wantLow  float64
+	}{
+		{"same place pays the minimum fare", sanFrancisco, sanFrancisco, 700, 7},
+		//41.6 miles driven in 83.2 minutes cost 2 + 1.5*41.6 + 0.25*83.2
+		{"rates add up", sanFrancisco, sanJose, 8519, 85.19},
+		{"either direction", sanJose, sanFrancisco, 8519, 85.19},
+	}
+	offline := offlinePriceEstimator{rates: testRates}
+	for _, test := range tests {
+		estimate, err := offline.Estimate(test.start, test.end, "")
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if estimate.Cost != test.wantCost || estimate.LowEstimate != test.wantLow || estimate.HighEstimate != test.wantLow {
+			t.Errorf("%s: got cost %d, range %v-%v, want %d, %v", test.name, estimate.Cost, estimate.LowEstimate, estimate.HighEstimate, test.wantCost, test.wantLow)
+		}
+		if estimate.Currency != offlineCurrency || estimate.ProductID != offlineProductID || estimate.Minimum != testRates.MinimumFare {
+			t.Errorf("%s: got currency %q, product %q, minimum %v", test.name, estimate.Currency, estimate.ProductID, estimate.Minimum)
+		}
+		if again, _ := offline.Estimate(test.start, test.end, ""); again != estimate {
+			t.Errorf("%s: the estimate changed from %+v to %+v", test.name, estimate, again)
+		}
+	}
+
+	if _, err := (offlinePriceEstimator{rates: offlineRates{MinimumFare: 7}}).Estimate(sanFrancisco, sanJose, ""); err == nil {
+		t.Error("an offline estimator without a speed did not fail")
+	}
+}
+
+func TestPlanTripWithOfflinePricer(t *testing.T) {
+	server, stop := newTestServer(t)
+	defer stop()
+	start := addTestLocation(t, server, "Office", "94105")
+	stops := []string{
+		addTestLocation(t, server, "Client", "95112"),
+		addTestLocation(t, server, "Lab", "94301"),
+		addTestLocation(t, server, "Warehouse", "94607"),
+	}
+
+	tests := []struct {
+		name      string
+		objective string
+		roundTrip bool
+		wantLegs  int
+	}{
+		{"cheapest round trip", objectiveCheapest, true, 4},
+		{"fastest one way", objectiveFastest, false, 3},
+		{"shortest round trip", objectiveShortest, true, 4},
+	}
+	for _, test := range tests {
+		request := UberPostRequest{StartingFromLocationID: start, LocationIds: stops, Objective: test.objective, RoundTrip: &test.roundTrip}
+		var trip UberResponse
+		if status := sendJSON(t, server, "POST", "/trips/", request, &trip); status != http.StatusCreated {
+			t.Fatalf("%s: got status %d", test.name, status)
+		}
+		if len(trip.BestRouteLocationIds) != len(stops) || len(trip.Legs) != test.wantLegs {
+			t.Fatalf("%s: got route %v and %d legs", test.name, trip.BestRouteLocationIds, len(trip.Legs))
+		}
+
+		//The totals are the sums of the legs, which chain from the start along the route
+		var cost int64
+		var duration int
+		from := start
+		for i, leg := range trip.Legs {
+			if leg.FromLocationID != from {
+				t.Errorf("%s: leg %d leaves from %s, want %s", test.name, i, leg.FromLocationID, from)
+			}
+			if leg.ProductID != offlineProductID || leg.CurrencyCode != offlineCurrency {
+				t.Errorf("%s: leg %d is priced as %q in %q", test.name, i, leg.ProductID, leg.CurrencyCode)
+			}
+			cost += toMinorUnits(leg.LowEstimate, leg.CurrencyCode)
+			duration += leg.Duration
+			from = leg.ToLocationID
+		}
+		if test.roundTrip && from != start {
+			t.Errorf("%s: the round trip ends at %s", test.name, from)
+		}
+		//The total of older clients stays in dollars
+		if trip.TotalLowEstimate != cost || trip.TotalUberCosts != toWholeUnits(cost, offlineCurrency) || trip.TotalUberDuration != duration {
+			t.Errorf("%s: got totals %d, $%d and %ds, the legs add up to %d cents and %ds", test.name, trip.TotalLowEstimate, trip.TotalUberCosts, trip.TotalUberDuration, cost, duration)
+		}
+		if trip.CurrencyCode != offlineCurrency || trip.Estimate != formatPriceRange(cost, cost, offlineCurrency) || trip.PartialEstimate {
+			t.Errorf("%s: got estimate %q in %q, partial %v", test.name, trip.Estimate, trip.CurrencyCode, trip.PartialEstimate)
+		}
+
+		var saved UberResponse
+		if status := sendJSON(t, server, "GET", "/trips/"+trip.ID.Hex(), nil, &saved); status != http.StatusOK || saved.TotalUberCosts != trip.TotalUberCosts {
+			t.Errorf("%s: got status %d and total %d for the saved trip", test.name, status, saved.TotalUberCosts)
+		}
+	}
+}
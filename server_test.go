@@ -0,0 +1,509 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+var testRates = offlineRates{BaseFare: 2, PerMile: 1.5, PerMinute: 0.25, MinimumFare: 7, SpeedMph: 30}
+
+// testZips is the gazetteer of the test server.
+var testZips = map[string]geocodeResult{
+	"94105": {Lat: 37.7898, Lng: -122.3942, City: "San Francisco", State: "CA", Zip: "94105", PlaceID: "zip:94105", LocationType: gazetteerLocationType},
+	"94607": {Lat: 37.8044, Lng: -122.2712, City: "Oakland", State: "CA", Zip: "94607", PlaceID: "zip:94607", LocationType: gazetteerLocationType},
+	"94301": {Lat: 37.4443, Lng: -122.1598, City: "Palo Alto", State: "CA", Zip: "94301", PlaceID: "zip:94301", LocationType: gazetteerLocationType},
+	"95112": {Lat: 37.3440, Lng: -121.8838, City: "San Jose", State: "CA", Zip: "95112", PlaceID: "zip:95112", LocationType: gazetteerLocationType},
+}
+
+// newTestServer serves the API from a memory store with the offline pricer and a
+// gazetteer of testZips. The returned function stops it and restores the globals.
+func newTestServer(t *testing.T) (*httptest.Server, func()) {
+	savedStore, savedGeocoder, savedPricer := store, locationGeocoder, pricer
+	store = newMemoryStore("")
+	locationGeocoder = newTestGazetteer(testZips)
+	pricer = offlinePriceEstimator{rates: testRates}
+	server := httptest.NewServer(newRouter())
+	return server, func() {
+		server.Close()
+		store, locationGeocoder, pricer = savedStore, savedGeocoder, savedPricer
+	}
+}
+
+// newTestGazetteer indexes results by ZIP code and city like loadGazetteer.
+func newTestGazetteer(results map[string]geocodeResult) gazetteerGeocoder {
+	gazetteer := gazetteerGeocoder{byZip: make(map[string]geocodeResult), byCity: make(map[string][]geocodeResult)}
+	for zip, result := range results {
+		gazetteer.byZip[zip] = result
+		city := gazetteerCity(result.City)
+		gazetteer.byCity[city] = append(gazetteer.byCity[city], result)
+	}
+	return gazetteer
+}
+
+// sendJSON sends body to the test server and decodes the response into out, if any.
+func sendJSON(t *testing.T, server *httptest.Server, method string, path string, body interface{}, out interface{}) int {
+	status, _ := sendJSONWithHeader(t, server, method, path, nil, body, out)
+	return status
+}
+
+// sendJSONWithHeader is sendJSON with request headers, returning the response headers.
+func sendJSONWithHeader(t *testing.T, server *httptest.Server, method string, path string, header http.Header, body interface{}, out interface{}) (int, http.Header) {
+	var encoded bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&encoded).Encode(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	request, err := http.NewRequest(method, server.URL+path, &encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, values := range header {
+		request.Header[key] = values
+	}
+	request.Header.Set("Content-Type", "application/json")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if out != nil {
+		if err := json.NewDecoder(response.Body).Decode(out); err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+	}
+	return response.StatusCode, response.Header
+}
+
+// addTestLocation saves a location in one of testZips and returns its ID.
+func addTestLocation(t *testing.T, server *httptest.Server, name string, zip string) string {
+	var location locationStruct
+	status := sendJSON(t, server, "POST", "/locations/", map[string]string{"name": name, "address": "1 Main St", "zip": zip}, &location)
+	if status != http.StatusCreated {
+		t.Fatalf("adding %s: got status %d", name, status)
+	}
+	return location.ID.Hex()
+}
+
+// stubGeocoder answers geocoding queries from results, keyed by the single line
+// address, and every reverse lookup with reverse. It counts the lookups it serves.
+type stubGeocoder struct {
+	results  map[string][]geocodeResult
+	reverse  []geocodeResult
+	err      error
+	geocodes int
+	reverses int
+}
+
+func (stub *stubGeocoder) Name() string {
+	return "stub"
+}
+
+func (stub *stubGeocoder) Geocode(query geocodeQuery) ([]geocodeResult, error) {
+	stub.geocodes++
+	return stub.results[query.String()], stub.err
+}
+
+func (stub *stubGeocoder) ReverseGeocode(lat float64, lng float64) ([]geocodeResult, error) {
+	stub.reverses++
+	return stub.reverse, stub.err
+}
+
+func TestReverseGeocodeLocation(t *testing.T) {
+	defer func(saved geocoder) { locationGeocoder = saved }(locationGeocoder)
+	stub := &stubGeocoder{reverse: []geocodeResult{
+		{Address: "1 Market St", City: "San Francisco"},
+		{City: "San Francisco County", State: "CA", Zip: "94105"},
+	}}
+	locationGeocoder = stub
+
+	//Each blank field comes from the first result that has it, the others are kept
+	location := locationStruct{City: "SF"}
+	if asked, err := reverseGeocodeLocation(&location); !asked || err != nil {
+		t.Fatalf("got %v, %v", asked, err)
+	}
+	if location.Address != "1 Market St" || location.City != "SF" || location.State != "CA" || location.Zip != "94105" {
+		t.Errorf("got %+v", location)
+	}
+
+	if asked, _ := reverseGeocodeLocation(&location); asked || stub.reverses != 1 {
+		t.Errorf("a complete address was looked up again")
+	}
+
+	stub.err = errors.New("quota exceeded")
+	_, err := reverseGeocodeLocation(&locationStruct{})
+	if apiErr, ok := err.(*apiError); !ok || apiErr.Status != http.StatusBadGateway {
+		t.Errorf("a failed lookup returned %v", err)
+	}
+}
+
+func TestAddLocationWithCoordinates(t *testing.T) {
+	server, stop := newTestServer(t)
+	defer stop()
+
+	oakland := testZips["94607"]
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+		wantCode   string
+		want       locationStruct
+	}{
+		{"coordinates only", `{"name": "Warehouse", "coordinate": {"lat": 37.805, "lng": -122.27}}`, http.StatusCreated, "",
+			locationStruct{City: oakland.City, State: oakland.State, Zip: oakland.Zip}},
+		{"address kept", `{"name": "Warehouse", "address": "7 Port Rd", "city": "West Oakland", "coordinate": {"lat": 37.805, "lng": -122.27}}`, http.StatusCreated, "",
+			locationStruct{Address: "7 Port Rd", City: "West Oakland", State: oakland.State, Zip: oakland.Zip}},
+		{"nothing nearby", `{"name": "Buoy", "coordinate": {"lat": 0, "lng": -140}}`, http.StatusCreated, "", locationStruct{}},
+		{"latitude out of range", `{"name": "Pole", "coordinate": {"lat": 91, "lng": 0}}`, http.StatusBadRequest, "invalid_coordinate", locationStruct{}},
+		{"longitude missing", `{"name": "Warehouse", "coordinate": {"lat": 37.805}}`, http.StatusBadRequest, "invalid_coordinate", locationStruct{}},
+	}
+	for _, test := range tests {
+		var location struct {
+			locationStruct
+			Code string `json:"code"`
+		}
+		status := sendJSON(t, server, "POST", "/locations/", json.RawMessage(test.body), &location)
+		if status != test.wantStatus || location.Code != test.wantCode {
+			t.Errorf("%s: got %d %q, want %d %q", test.name, status, location.Code, test.wantStatus, test.wantCode)
+			continue
+		}
+		if status != http.StatusCreated {
+			continue
+		}
+		var sent struct {
+			Coordinate struct{ Lat, Lng float64 } `json:"coordinate"`
+		}
+		json.Unmarshal([]byte(test.body), &sent)
+		//The posted coordinate is kept rather than moved to the centroid found
+		if location.Coordinate.Lat != sent.Coordinate.Lat || location.Coordinate.Lng != sent.Coordinate.Lng {
+			t.Errorf("%s: the coordinate moved to %+v", test.name, location.Coordinate)
+		}
+		if location.Address != test.want.Address || location.City != test.want.City || location.State != test.want.State || location.Zip != test.want.Zip {
+			t.Errorf("%s: got address %q, %q, %q, %q", test.name, location.Address, location.City, location.State, location.Zip)
+		}
+	}
+}
+
+func TestAmbiguousResults(t *testing.T) {
+	sanFrancisco, oakland, sanJose := testZips["94105"], testZips["94607"], testZips["95112"]
+	rooftop := func(result geocodeResult) geocodeResult {
+		result.LocationType = "ROOFTOP"
+		return result
+	}
+	partial := func(result geocodeResult) geocodeResult {
+		result.PartialMatch = true
+		return result
+	}
+	tests := []struct {
+		name    string
+		results []geocodeResult
+		want    bool
+	}{
+		{"one result", []geocodeResult{sanFrancisco}, false},
+		{"same place found twice", []geocodeResult{sanFrancisco, oakland}, false},
+		{"equally good and far apart", []geocodeResult{sanFrancisco, sanJose}, true},
+		{"the other is less precise", []geocodeResult{rooftop(sanFrancisco), sanJose}, false},
+		{"the other is more precise", []geocodeResult{sanFrancisco, rooftop(sanJose)}, true},
+		{"the other only partially matches", []geocodeResult{sanFrancisco, partial(sanJose)}, false},
+		{"both partially match", []geocodeResult{partial(sanFrancisco), partial(sanJose)}, true},
+	}
+	for _, test := range tests {
+		if got := ambiguousResults(test.results); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestAddLocationWithAmbiguousAddress(t *testing.T) {
+	server, stop := newTestServer(t)
+	defer stop()
+	portlandOregon := geocodeResult{FormattedAddress: "1 Main St, Portland, OR", Lat: 45.5152, Lng: -122.6784, PlaceID: "or"}
+	portlandMaine := geocodeResult{FormattedAddress: "1 Main St, Portland, ME", Lat: 43.6591, Lng: -70.2568, PlaceID: "me"}
+	stub := &stubGeocoder{results: map[string][]geocodeResult{
+		"1 Main St, Portland":     {portlandOregon, portlandMaine},
+		"1 Main St, Portland, OR": {portlandOregon},
+		"9 Elm St, Portland":      {{FormattedAddress: "Elm St, Portland, OR", Lat: 45.5, Lng: -122.6, PlaceID: "elm", PartialMatch: true}},
+	}}
+	locationGeocoder = stub
+
+	type candidates struct {
+		locationStruct
+		Code    string `json:"code"`
+		Details struct {
+			Candidates []geocodeCandidate `json:"candidates"`
+		} `json:"details"`
+	}
+	var ambiguous candidates
+	status := sendJSON(t, server, "POST", "/locations/", map[string]string{"name": "Office", "address": "1 Main St", "city": "Portland"}, &ambiguous)
+	if status != http.StatusMultipleChoices || ambiguous.Code != "ambiguous_address" || len(ambiguous.Details.Candidates) != 2 {
+		t.Fatalf("got %d %q with candidates %+v", status, ambiguous.Code, ambiguous.Details.Candidates)
+	}
+	if candidate := ambiguous.Details.Candidates[1]; candidate.PlaceID != "me" || candidate.Lat != portlandMaine.Lat || candidate.FormattedAddress != portlandMaine.FormattedAddress {
+		t.Errorf("got candidate %+v", candidate)
+	}
+
+	//Resending with the place_id of a candidate picks it
+	var chosen candidates
+	status = sendJSON(t, server, "POST", "/locations/", map[string]string{"name": "Office", "address": "1 Main St", "city": "Portland", "place_id": "me"}, &chosen)
+	if status != http.StatusCreated || chosen.PlaceID != "me" || chosen.Coordinate.Lat != portlandMaine.Lat || chosen.Coordinate.Lng != portlandMaine.Lng {
+		t.Errorf("choosing a candidate got %d %+v", status, chosen.locationStruct)
+	}
+
+	tests := []struct {
+		name       string
+		body       map[string]string
+		wantStatus int
+		wantCode   string
+	}{
+		{"unknown place_id", map[string]string{"name": "Office", "address": "1 Main St", "city": "Portland", "place_id": "tx"}, http.StatusUnprocessableEntity, "place_not_found"},
+		{"partial match", map[string]string{"name": "Office", "address": "9 Elm St", "city": "Portland"}, http.StatusUnprocessableEntity, "partial_match"},
+		{"partial match accepted", map[string]string{"name": "Office", "address": "9 Elm St", "city": "Portland", "place_id": "elm"}, http.StatusCreated, ""},
+		{"one match", map[string]string{"name": "Office", "address": "1 Main St", "city": "Portland", "state": "OR"}, http.StatusCreated, ""},
+		{"no match", map[string]string{"name": "Office", "address": "1 Main St", "city": "Nowhere"}, http.StatusUnprocessableEntity, "address_not_found"},
+		{"no address", map[string]string{"name": "Office"}, http.StatusBadRequest, "missing_address"},
+	}
+	for _, test := range tests {
+		var response candidates
+		status := sendJSON(t, server, "POST", "/locations/", test.body, &response)
+		if status != test.wantStatus || response.Code != test.wantCode {
+			t.Errorf("%s: got %d %q, want %d %q", test.name, status, response.Code, test.wantStatus, test.wantCode)
+		}
+		if test.wantStatus == http.StatusUnprocessableEntity && test.wantCode != "address_not_found" && len(response.Details.Candidates) == 0 {
+			t.Errorf("%s: no candidates were offered", test.name)
+		}
+	}
+}
+
+// addTestTrip plans a round trip from San Francisco by way of San Jose and returns
+// its ID and ETag.
+func addTestTrip(t *testing.T, server *httptest.Server) (string, string) {
+	request := UberPostRequest{StartingFromLocationID: addTestLocation(t, server, "Office", "94105"), LocationIds: []string{addTestLocation(t, server, "Client", "95112")}}
+	var trip UberResponse
+	status, header := sendJSONWithHeader(t, server, "POST", "/trips/", nil, request, &trip)
+	if status != http.StatusCreated {
+		t.Fatalf("planning the trip: got status %d", status)
+	}
+	return trip.ID.Hex(), header.Get("ETag")
+}
+
+// failingTripStore fails every update of a trip after the first allowed ones.
+type failingTripStore struct {
+	*memoryStore
+	allowed int
+}
+
+func (failing *failingTripStore) UpdateTrip(trip UberResponse, version int) error {
+	if failing.allowed == 0 {
+		return errors.New("connection reset")
+	}
+	failing.allowed--
+	return failing.memoryStore.UpdateTrip(trip, version)
+}
+
+func TestRequestTripPreconditions(t *testing.T) {
+	server, stop := newTestServer(t)
+	defer stop()
+	tripID, etag := addTestTrip(t, server)
+
+	tests := []struct {
+		name       string
+		ifMatch    string
+		wantStatus int
+		wantCode   string
+	}{
+		{"no If-Match", "", http.StatusPreconditionRequired, "missing_if_match"},
+		{"stale If-Match", `"9"`, http.StatusPreconditionFailed, "version_conflict"},
+		//Rides are only booked with a sandbox token, which is checked before claiming the trip
+		{"no sandbox token", etag, http.StatusServiceUnavailable, "ride_requests_disabled"},
+		{"no sandbox token again", etag, http.StatusServiceUnavailable, "ride_requests_disabled"},
+	}
+	for _, test := range tests {
+		header := http.Header{}
+		if len(test.ifMatch) > 0 {
+			header.Set("If-Match", test.ifMatch)
+		}
+		var failed apiError
+		status, _ := sendJSONWithHeader(t, server, "PUT", "/trips/"+tripID+"/request", header, nil, &failed)
+		if status != test.wantStatus || failed.Code != test.wantCode {
+			t.Errorf("%s: got %d %q, want %d %q", test.name, status, failed.Code, test.wantStatus, test.wantCode)
+		}
+	}
+	var trip UberResponse
+	if _, header := sendJSONWithHeader(t, server, "GET", "/trips/"+tripID, nil, nil, &trip); header.Get("ETag") != etag || trip.Status != "planning" || trip.BookingClaimedAt != nil {
+		t.Errorf("the refused requests changed the trip to %s, %q", header.Get("ETag"), trip.Status)
+	}
+}
+
+func TestRequestTripReleasesFailedBookings(t *testing.T) {
+	server, stop := newTestServer(t)
+	defer stop()
+	defer func(token string) { config.UberSandboxToken = token }(config.UberSandboxToken)
+	config.UberSandboxToken = "sandbox"
+	tripID, etag := addTestTrip(t, server)
+	//The product of the ride is looked up once the trip is claimed, and fails
+	failing := newCountingEstimator(0)
+	failing.fail = true
+	pricer = failing
+
+	for attempt := 0; attempt < 2; attempt++ {
+		var failed apiError
+		status, header := sendJSONWithHeader(t, server, "PUT", "/trips/"+tripID+"/request", http.Header{"If-Match": {etag}}, nil, &failed)
+		if status != http.StatusBadGateway || failed.Code != "upstream_error" {
+			t.Fatalf("attempt %d: got %d %q", attempt, status, failed.Code)
+		}
+		//The trip is released as it was, so the client's ETag still holds
+		if header.Get("ETag") != etag {
+			t.Errorf("attempt %d: got ETag %s, want %s", attempt, header.Get("ETag"), etag)
+		}
+	}
+	trip, _ := store.FindTrip(tripID)
+	if versionETag(trip.Version) != etag || trip.BookingClaimedAt != nil || trip.Status != "planning" || failing.totalCalls() != 2 {
+		t.Errorf("the failed bookings left version %d, claim %v, status %q after %d lookups", trip.Version, trip.BookingClaimedAt, trip.Status, failing.totalCalls())
+	}
+}
+
+func TestRequestTripBookingLease(t *testing.T) {
+	server, stop := newTestServer(t)
+	defer stop()
+	defer func(token string) { config.UberSandboxToken = token }(config.UberSandboxToken)
+	config.UberSandboxToken = "sandbox"
+	tripID, etag := addTestTrip(t, server)
+	failing := newCountingEstimator(0)
+	failing.fail = true
+	pricer = failing
+
+	//The claim is stored, but releasing it fails
+	store = &failingTripStore{memoryStore: store.(*memoryStore), allowed: 1}
+	var failed struct {
+		Code    string `json:"code"`
+		Details struct {
+			BookingError apiError `json:"booking_error"`
+		} `json:"details"`
+	}
+	status, header := sendJSONWithHeader(t, server, "PUT", "/trips/"+tripID+"/request", http.Header{"If-Match": {etag}}, nil, &failed)
+	if status != http.StatusInternalServerError || failed.Code != "booking_not_released" || failed.Details.BookingError.Code != "upstream_error" {
+		t.Fatalf("got %d %+v", status, failed)
+	}
+	claimedETag := header.Get("ETag")
+	trip, _ := store.FindTrip(tripID)
+	if claimedETag == etag || versionETag(trip.Version) != claimedETag || trip.BookingClaimedAt == nil {
+		t.Fatalf("got ETag %s for the claimed trip at version %d", claimedETag, trip.Version)
+	}
+
+	//Until the lease expires the trip is being booked
+	store = store.(*failingTripStore).memoryStore
+	status, _ = sendJSONWithHeader(t, server, "PUT", "/trips/"+tripID+"/request", http.Header{"If-Match": {claimedETag}}, nil, &failed)
+	if status != http.StatusConflict || failed.Code != "booking_in_progress" {
+		t.Errorf("a request during the lease got %d %q", status, failed.Code)
+	}
+
+	//Afterwards the claim is ignored, and released by the next booking that fails
+	expired := trip.BookingClaimedAt.Add(-bookingLease)
+	trip.BookingClaimedAt = &expired
+	store.UpdateTrip(trip, trip.Version)
+	status, header = sendJSONWithHeader(t, server, "PUT", "/trips/"+tripID+"/request", http.Header{"If-Match": {claimedETag}}, nil, &failed)
+	if status != http.StatusBadGateway || header.Get("ETag") != claimedETag {
+		t.Errorf("a request after the lease got %d %q and ETag %s", status, failed.Code, header.Get("ETag"))
+	}
+}
+
+// failingTombstoneStore cannot save tombstones.
+type failingTombstoneStore struct {
+	*memoryStore
+}
+
+func (failing failingTombstoneStore) SaveTombstone(tombstone locationTombstone) error {
+	return errors.New("disk full")
+}
+
+func TestRemoveLocationWithTombstones(t *testing.T) {
+	defer func(saved tripPlannerStore, policy string) { store, config.LocationDeletePolicy = saved, policy }(store, config.LocationDeletePolicy)
+	config.LocationDeletePolicy = deletePolicyTombstone
+	memory := newMemoryStore("")
+	store = memory
+
+	stale := testLocation("Office", 1)
+	memory.InsertLocation(stale)
+	current := stale
+	current.Version = 2
+	memory.UpdateLocation(current, 1)
+	missing := testLocation("Lab", 1)
+
+	tests := []struct {
+		name     string
+		location locationStruct
+		wantErr  error
+	}{
+		{"changed since it was read", stale, errVersionConflict},
+		{"already gone", missing, errNotFound},
+	}
+	for _, test := range tests {
+		if err := removeLocation(test.location); err != test.wantErr {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.wantErr)
+		}
+		if _, err := memory.FindTombstone(test.location.ID.Hex()); err != errNotFound {
+			t.Errorf("%s: the failed delete left a tombstone", test.name)
+		}
+	}
+
+	//A tombstone that cannot be saved puts the location back
+	store = failingTombstoneStore{memory}
+	if err := removeLocation(current); err == nil {
+		t.Error("the delete succeeded without its tombstone")
+	}
+	if location, err := memory.FindLocation(current.ID.Hex()); err != nil || location.Version != 2 {
+		t.Errorf("the location was not put back, %v", err)
+	}
+
+	store = memory
+	if err := removeLocation(current); err != nil {
+		t.Fatal(err)
+	}
+	if tombstone, err := memory.FindTombstone(current.ID.Hex()); err != nil || tombstone.Location.Version != 2 || time.Since(tombstone.DeletedAt) > time.Minute {
+		t.Errorf("got tombstone %+v, %v", tombstone, err)
+	}
+}
+
+func TestDeleteLocationPolicies(t *testing.T) {
+	server, stop := newTestServer(t)
+	defer stop()
+	defer func(policy string) { config.LocationDeletePolicy = policy }(config.LocationDeletePolicy)
+	tripID, _ := addTestTrip(t, server)
+	trip, _ := store.FindTrip(tripID)
+	client := trip.BestRouteLocationIds[0]
+	deleteClient := func() (int, apiError) {
+		var failed apiError
+		status, _ := sendJSONWithHeader(t, server, "DELETE", "/locations/"+client, http.Header{"If-Match": {"*"}}, nil, &failed)
+		return status, failed
+	}
+
+	config.LocationDeletePolicy = deletePolicyBlock
+	if status, failed := deleteClient(); status != http.StatusConflict || failed.Code != "location_in_use" {
+		t.Errorf("deleting a location of an active trip got %d %q", status, failed.Code)
+	}
+
+	config.LocationDeletePolicy = deletePolicyTombstone
+	if status, _ := deleteClient(); status != http.StatusOK {
+		t.Fatalf("deleting with tombstones got %d", status)
+	}
+	var gone struct {
+		Code    string            `json:"code"`
+		Details locationTombstone `json:"details"`
+	}
+	if status := sendJSON(t, server, "GET", "/locations/"+client, nil, &gone); status != http.StatusGone || gone.Code != "location_deleted" || gone.Details.Location.Name != "Client" {
+		t.Errorf("the deleted location got %d %+v", status, gone)
+	}
+	//The trip still knows the location it was planned with
+	if location, err := obtainLocation(trip, client); err != nil || location.Name != "Client" {
+		t.Errorf("the trip lost its stop, %v", err)
+	}
+	trip.PlannedLocations = nil
+	if location, err := obtainLocation(trip, client); err != nil || location.Name != "Client" {
+		t.Errorf("the tombstone was not used, %v", err)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+var errNotFound = errors.New("not found")
+var errDuplicate = errors.New("duplicate ID")
+
+// errVersionConflict is returned when a document changed since the caller read it.
+var errVersionConflict = errors.New("version conflict")
+
+// errInvalidID is returned for IDs that are not 24 character hex ObjectIds.
+type errInvalidID string
+
+func (id errInvalidID) Error() string {
+	return fmt.Sprintf("invalid ID %q", string(id))
+}
+
+func parseObjectID(id string) (bson.ObjectId, error) {
+	if !bson.IsObjectIdHex(id) {
+		return "", errInvalidID(id)
+	}
+	return bson.ObjectIdHex(id), nil
+}
+
+// locationStore persists the saved addresses.
+type locationStore interface {
+	InsertLocation(location locationStruct) error
+	FindLocation(id string) (locationStruct, error)
+	//UpdateLocation and DeleteLocation only apply while the saved location is still at version
+	UpdateLocation(location locationStruct, version int) error
+	DeleteLocation(id string, version int) error
+	ListLocations(query locationQuery) (locationPage, error)
+	//NearbyLocations returns up to limit locations within radiusMiles of lat/lng, nearest first
+	NearbyLocations(lat float64, lng float64, radiusMiles float64, limit int) ([]nearbyLocation, error)
+	//LocationsWithin returns up to limit locations inside box, nearest to its center first
+	LocationsWithin(box geoBox, limit int) ([]nearbyLocation, error)
+	//SaveTombstone records a deleted location, replacing an earlier record of it
+	SaveTombstone(tombstone locationTombstone) error
+	FindTombstone(id string) (locationTombstone, error)
+	InsertAudit(record locationAudit) error
+	//LocationHistory returns the recorded changes of a location, oldest first
+	LocationHistory(id string) ([]locationAudit, error)
+}
+
+// locationTombstone is what remains of a location deleted under the tombstone policy.
+type locationTombstone struct {
+	Location  locationStruct `json:"location" bson:",inline"`
+	DeletedAt time.Time      `json:"deleted_at" bson:"deleted_at"`
+}
+
+// tripStore persists the planned trips.
+type tripStore interface {
+	InsertTrip(trip UberResponse) error
+	FindTrip(id string) (UberResponse, error)
+	//UpdateTrip only applies while the saved trip is still at version
+	UpdateTrip(trip UberResponse, version int) error
+	//ActiveTripsUsingLocation returns the IDs of the trips that are not completed and
+	//start at or stop by the location
+	ActiveTripsUsingLocation(id string) ([]string, error)
+}
+
+// geocodeCacheStore persists geocoding answers keyed by normalized address.
+type geocodeCacheStore interface {
+	FindGeocode(key string) (geocodeCacheEntry, error)
+	//SaveGeocode adds the entry or replaces the one with the same key
+	SaveGeocode(entry geocodeCacheEntry) error
+	DeleteGeocode(key string) error
+	//PurgeGeocodes removes the entries cached before the given time and returns how many
+	PurgeGeocodes(cachedBefore time.Time) (int, error)
+	CountGeocodes() (int, error)
+}
+
+// tripPlannerStore is everything the handlers need from a storage backend.
+type tripPlannerStore interface {
+	locationStore
+	tripStore
+	geocodeCacheStore
+	Close() error
+}
+
+// store is the storage backend used by the handlers, set up in main.
+var store tripPlannerStore
+
+func newStore(cfg serverConfig) (tripPlannerStore, error) {
+	switch cfg.StoreProvider {
+	case "mongo":
+		if len(cfg.MongoURL) == 0 {
+			return nil, fmt.Errorf("TRIP_MONGO_URL is required with the mongo store")
+		}
+		return newMongoStore(cfg.MongoURL, cfg.MongoDBName)
+	case "memory":
+		return newMemoryStore(""), nil
+	case "file":
+		return openFileStore(cfg.StoreFile)
+	}
+	return nil, fmt.Errorf("unknown store %q, expected mongo, memory or file", cfg.StoreProvider)
+}
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+const memoryGeohashPrecision int = maxGeohashPrecision
+
+// memoryStore keeps locations and trips in maps. When path is set every change is
+// written to that JSON file, so the embedded store survives restarts.
+type memoryStore struct {
+	mu        sync.RWMutex
+	path      string
+	locations map[bson.ObjectId]locationStruct
+	trips     map[bson.ObjectId]UberResponse
+	geocodes  map[string]geocodeCacheEntry
+	deleted   map[bson.ObjectId]locationTombstone
+	history   map[bson.ObjectId][]locationAudit
+	//geoIndex holds the geohash of every location sorted by hash, so the locations
+	//of a cell are a contiguous run found by binary search
+	geoIndex  []geoIndexEntry
+	geohashes map[bson.ObjectId]string
+}
+
+type geoIndexEntry struct {
+	hash string
+	id   bson.ObjectId
+}
+
+// memorySnapshot is the on-disk format of a file backed memoryStore.
+type memorySnapshot struct {
+	Locations []locationStruct    `json:"locations"`
+	Trips     []UberResponse      `json:"trips"`
+	Geocodes  []geocodeCacheEntry `json:"geocodes,omitempty"`
+	Deleted   []locationTombstone `json:"deleted_locations,omitempty"`
+	History   []locationAudit     `json:"history,omitempty"`
+}
+
+func newMemoryStore(path string) *memoryStore {
+	return &memoryStore{
+		path:      path,
+		locations: make(map[bson.ObjectId]locationStruct),
+		trips:     make(map[bson.ObjectId]UberResponse),
+		geocodes:  make(map[string]geocodeCacheEntry),
+		deleted:   make(map[bson.ObjectId]locationTombstone),
+		history:   make(map[bson.ObjectId][]locationAudit),
+		geohashes: make(map[bson.ObjectId]string),
+	}
+}
+
+// openFileStore loads the store saved at path, starting empty if the file does not exist yet.
+func openFileStore(path string) (*memoryStore, error) {
+	memory := newMemoryStore(path)
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return memory, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var snapshot memorySnapshot
+	err = json.Unmarshal(data, &snapshot)
+	if err != nil {
+		return nil, err
+	}
+	for _, location := range snapshot.Locations {
+		memory.locations[location.ID] = location
+		memory.indexLocation(location)
+	}
+	for _, trip := range snapshot.Trips {
+		memory.trips[trip.ID] = trip
+	}
+	for _, entry := range snapshot.Geocodes {
+		memory.geocodes[entry.Key] = entry
+	}
+	for _, tombstone := range snapshot.Deleted {
+		memory.deleted[tombstone.Location.ID] = tombstone
+	}
+	for _, record := range snapshot.History {
+		memory.history[record.LocationID] = append(memory.history[record.LocationID], record)
+	}
+	return memory, nil
+}
+
+// save writes the snapshot file through a temporary file so a crash never leaves it
+// half written. The caller holds memory.mu.
+func (memory *memoryStore) save() error {
+	if len(memory.path) == 0 {
+		return nil
+	}
+	snapshot := memorySnapshot{Locations: make([]locationStruct, 0, len(memory.locations)), Trips: make([]UberResponse, 0, len(memory.trips))}
+	for _, location := range memory.locations {
+		snapshot.Locations = append(snapshot.Locations, location)
+	}
+	for _, trip := range memory.trips {
+		snapshot.Trips = append(snapshot.Trips, trip)
+	}
+	for _, entry := range memory.geocodes {
+		snapshot.Geocodes = append(snapshot.Geocodes, entry)
+	}
+	for _, tombstone := range memory.deleted {
+		snapshot.Deleted = append(snapshot.Deleted, tombstone)
+	}
+	for _, history := range memory.history {
+		snapshot.History = append(snapshot.History, history...)
+	}
+	data, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return err
+	}
+	temp, err := ioutil.TempFile(filepath.Dir(memory.path), filepath.Base(memory.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = temp.Write(data)
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(temp.Name())
+		return err
+	}
+	return os.Rename(temp.Name(), memory.path)
+}
+
+func (memory *memoryStore) Close() error {
+	return nil
+}
+
+func (memory *memoryStore) InsertLocation(location locationStruct) error {
+	memory.mu.Lock()
+	defer memory.mu.Unlock()
+	if _, ok := memory.locations[location.ID]; ok {
+		return errDuplicate
+	}
+	memory.locations[location.ID] = location
+	memory.indexLocation(location)
+	return memory.save()
+}
+
+func (memory *memoryStore) FindLocation(id string) (locationStruct, error) {
+	objectID, err := parseObjectID(id)
+	if err != nil {
+		return locationStruct{}, err
+	}
+	memory.mu.RLock()
+	defer memory.mu.RUnlock()
+	location, ok := memory.locations[objectID]
+	if !ok {
+		return locationStruct{}, errNotFound
+	}
+	return location, nil
+}
+
+func (memory *memoryStore) UpdateLocation(location locationStruct, version int) error {
+	memory.mu.Lock()
+	defer memory.mu.Unlock()
+	saved, ok := memory.locations[location.ID]
+	if !ok {
+		return errNotFound
+	}
+	if saved.Version != version {
+		return errVersionConflict
+	}
+	memory.locations[location.ID] = location
+	memory.indexLocation(location)
+	return memory.save()
+}
+
+func (memory *memoryStore) DeleteLocation(id string, version int) error {
+	objectID, err := parseObjectID(id)
+	if err != nil {
+		return err
+	}
+	memory.mu.Lock()
+	defer memory.mu.Unlock()
+	saved, ok := memory.locations[objectID]
+	if !ok {
+		return errNotFound
+	}
+	if saved.Version != version {
+		return errVersionConflict
+	}
+	delete(memory.locations, objectID)
+	memory.unindexLocation(objectID)
+	return memory.save()
+}
+
+func (memory *memoryStore) SaveTombstone(tombstone locationTombstone) error {
+	memory.mu.Lock()
+	defer memory.mu.Unlock()
+	memory.deleted[tombstone.Location.ID] = tombstone
+	return memory.save()
+}
+
+func (memory *memoryStore) FindTombstone(id string) (locationTombstone, error) {
+	objectID, err := parseObjectID(id)
+	if err != nil {
+		return locationTombstone{}, err
+	}
+	memory.mu.RLock()
+	defer memory.mu.RUnlock()
+	tombstone, ok := memory.deleted[objectID]
+	if !ok {
+		return locationTombstone{}, errNotFound
+	}
+	return tombstone, nil
+}
+
+func (memory *memoryStore) InsertAudit(record locationAudit) error {
+	memory.mu.Lock()
+	defer memory.mu.Unlock()
+	memory.history[record.LocationID] = append(memory.history[record.LocationID], record)
+	return memory.save()
+}
+
+func (memory *memoryStore) LocationHistory(id string) ([]locationAudit, error) {
+	objectID, err := parseObjectID(id)
+	if err != nil {
+		return nil, err
+	}
+	memory.mu.RLock()
+	defer memory.mu.RUnlock()
+	return append([]locationAudit{}, memory.history[objectID]...), nil
+}
+
+func (memory *memoryStore) ListLocations(query locationQuery) (locationPage, error) {
+	memory.mu.RLock()
+	locations := make([]locationStruct, 0)
+	for _, location := range memory.locations {
+		if query.matches(location) && query.isAfterCursor(location) {
+			locations = append(locations, location)
+		}
+	}
+	memory.mu.RUnlock()
+
+	sort.Slice(locations, func(i, j int) bool { return query.less(locations[i], locations[j]) })
+	if len(locations) > query.Limit+1 {
+		locations = locations[:query.Limit+1]
+	}
+	return newLocationPage(query, locations), nil
+}
+
+// indexLocation adds or moves the location in the geohash index. The caller holds memory.mu.
+func (memory *memoryStore) indexLocation(location locationStruct) {
+	memory.unindexLocation(location.ID)
+	entry := geoIndexEntry{hash: geohashEncode(location.Coordinate.Lat, location.Coordinate.Lng, memoryGeohashPrecision), id: location.ID}
+	i := sort.Search(len(memory.geoIndex), func(i int) bool { return memory.geoIndex[i].hash >= entry.hash })
+	memory.geoIndex = append(memory.geoIndex, geoIndexEntry{})
+	copy(memory.geoIndex[i+1:], memory.geoIndex[i:])
+	memory.geoIndex[i] = entry
+	memory.geohashes[location.ID] = entry.hash
+}
+
+// unindexLocation removes the location from the geohash index. The caller holds memory.mu.
+func (memory *memoryStore) unindexLocation(id bson.ObjectId) {
+	hash, ok := memory.geohashes[id]
+	if !ok {
+		return
+	}
+	for i := sort.Search(len(memory.geoIndex), func(i int) bool { return memory.geoIndex[i].hash >= hash }); i < len(memory.geoIndex); i++ {
+		if memory.geoIndex[i].id == id {
+			memory.geoIndex = append(memory.geoIndex[:i], memory.geoIndex[i+1:]...)
+			break
+		}
+	}
+	delete(memory.geohashes, id)
+}
+
+// locationsInBox looks up the geohash cells covering box and keeps the locations
+// that are actually inside it.
+func (memory *memoryStore) locationsInBox(box geoBox) []locationStruct {
+	memory.mu.RLock()
+	defer memory.mu.RUnlock()
+	locations := make([]locationStruct, 0)
+	seen := make(map[bson.ObjectId]bool)
+	for _, prefix := range coveringGeohashes(box, 32) {
+		for i := sort.Search(len(memory.geoIndex), func(i int) bool { return memory.geoIndex[i].hash >= prefix }); i < len(memory.geoIndex); i++ {
+			entry := memory.geoIndex[i]
+			if !strings.HasPrefix(entry.hash, prefix) {
+				break
+			}
+			location := memory.locations[entry.id]
+			if !seen[entry.id] && box.contains(location.Coordinate.Lat, location.Coordinate.Lng) {
+				seen[entry.id] = true
+				locations = append(locations, location)
+			}
+		}
+	}
+	return locations
+}
+
+func (memory *memoryStore) NearbyLocations(lat float64, lng float64, radiusMiles float64, limit int) ([]nearbyLocation, error) {
+	candidates := memory.locationsInBox(circleBox(lat, lng, radiusMiles))
+	nearby := sortByDistance(candidates, lat, lng, len(candidates))
+	for i, location := range nearby {
+		if location.Distance > radiusMiles {
+			nearby = nearby[:i]
+			break
+		}
+	}
+	if len(nearby) > limit {
+		nearby = nearby[:limit]
+	}
+	return nearby, nil
+}
+
+func (memory *memoryStore) LocationsWithin(box geoBox, limit int) ([]nearbyLocation, error) {
+	lat, lng := box.center()
+	return sortByDistance(memory.locationsInBox(box), lat, lng, limit), nil
+}
+
+func (memory *memoryStore) InsertTrip(trip UberResponse) error {
+	memory.mu.Lock()
+	defer memory.mu.Unlock()
+	if _, ok := memory.trips[trip.ID]; ok {
+		return errDuplicate
+	}
+	memory.trips[trip.ID] = trip
+	return memory.save()
+}
+
+func (memory *memoryStore) FindTrip(id string) (UberResponse, error) {
+	objectID, err := parseObjectID(id)
+	if err != nil {
+		return UberResponse{}, err
+	}
+	memory.mu.RLock()
+	defer memory.mu.RUnlock()
+	trip, ok := memory.trips[objectID]
+	if !ok {
+		return UberResponse{}, errNotFound
+	}
+	return trip, nil
+}
+
+func (memory *memoryStore) UpdateTrip(trip UberResponse, version int) error {
+	memory.mu.Lock()
+	defer memory.mu.Unlock()
+	saved, ok := memory.trips[trip.ID]
+	if !ok {
+		return errNotFound
+	}
+	if saved.Version != version {
+		return errVersionConflict
+	}
+	memory.trips[trip.ID] = trip
+	return memory.save()
+}
+
+func (memory *memoryStore) ActiveTripsUsingLocation(id string) ([]string, error) {
+	memory.mu.RLock()
+	defer memory.mu.RUnlock()
+	tripIDs := make([]string, 0)
+	for _, trip := range memory.trips {
+		if trip.Status == "completed" {
+			continue
+		}
+		uses := trip.StartingFromLocationID == id
+		for _, stopID := range trip.BestRouteLocationIds {
+			uses = uses || stopID == id
+		}
+		if uses {
+			tripIDs = append(tripIDs, trip.ID.Hex())
+		}
+	}
+	sort.Strings(tripIDs)
+	return tripIDs, nil
+}
+
+func (memory *memoryStore) FindGeocode(key string) (geocodeCacheEntry, error) {
+	memory.mu.RLock()
+	defer memory.mu.RUnlock()
+	entry, ok := memory.geocodes[key]
+	if !ok {
+		return geocodeCacheEntry{}, errNotFound
+	}
+	return entry, nil
+}
+
+func (memory *memoryStore) SaveGeocode(entry geocodeCacheEntry) error {
+	memory.mu.Lock()
+	defer memory.mu.Unlock()
+	memory.geocodes[entry.Key] = entry
+	return memory.save()
+}
+
+func (memory *memoryStore) DeleteGeocode(key string) error {
+	memory.mu.Lock()
+	defer memory.mu.Unlock()
+	if _, ok := memory.geocodes[key]; !ok {
+		return errNotFound
+	}
+	delete(memory.geocodes, key)
+	return memory.save()
+}
+
+func (memory *memoryStore) PurgeGeocodes(cachedBefore time.Time) (int, error) {
+	memory.mu.Lock()
+	defer memory.mu.Unlock()
+	purged := 0
+	for key, entry := range memory.geocodes {
+		if entry.CachedAt.Before(cachedBefore) {
+			delete(memory.geocodes, key)
+			purged++
+		}
+	}
+	if purged == 0 {
+		return 0, nil
+	}
+	return purged, memory.save()
+}
+
+func (memory *memoryStore) CountGeocodes() (int, error) {
+	memory.mu.RLock()
+	defer memory.mu.RUnlock()
+	return len(memory.geocodes), nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func testLocation(name string, version int) locationStruct {
+	location := locationStruct{ID: bson.NewObjectId(), Name: name, Zip: "94105", Version: version}
+	location.Coordinate.Lat, location.Coordinate.Lng = testZips["94105"].Lat, testZips["94105"].Lng
+	return location
+}
+
+func TestMemoryStoreLocations(t *testing.T) {
+	memory := newMemoryStore("")
+	location := testLocation("Office", 1)
+	if err := memory.InsertLocation(location); err != nil {
+		t.Fatal(err)
+	}
+	if err := memory.InsertLocation(location); err != errDuplicate {
+		t.Errorf("inserting twice returned %v, want errDuplicate", err)
+	}
+	if found, err := memory.FindLocation(location.ID.Hex()); err != nil || found.Name != "Office" {
+		t.Errorf("got %+v, %v", found, err)
+	}
+
+	renamed := location
+	renamed.Name, renamed.Version = "Head office", 2
+	if err := memory.UpdateLocation(renamed, 2); err != errVersionConflict {
+		t.Errorf("an update at the wrong version returned %v", err)
+	}
+	if err := memory.UpdateLocation(renamed, 1); err != nil {
+		t.Fatal(err)
+	}
+	if found, _ := memory.FindLocation(location.ID.Hex()); found.Name != "Head office" || found.Version != 2 {
+		t.Errorf("the update saved %+v", found)
+	}
+
+	if err := memory.DeleteLocation(location.ID.Hex(), 1); err != errVersionConflict {
+		t.Errorf("a delete at the wrong version returned %v", err)
+	}
+	if err := memory.DeleteLocation(location.ID.Hex(), 2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := memory.FindLocation(location.ID.Hex()); err != errNotFound {
+		t.Errorf("the deleted location is still found, %v", err)
+	}
+	if err := memory.DeleteLocation(location.ID.Hex(), 2); err != errNotFound {
+		t.Errorf("deleting twice returned %v", err)
+	}
+	if err := memory.UpdateLocation(renamed, 2); err != errNotFound {
+		t.Errorf("updating a deleted location returned %v", err)
+	}
+	if _, err := memory.FindLocation("not-an-id"); err != errInvalidID("not-an-id") {
+		t.Errorf("an invalid ID returned %v", err)
+	}
+}
+
+func TestMemoryStoreTrips(t *testing.T) {
+	memory := newMemoryStore("")
+	start := bson.NewObjectId().Hex()
+	stop := bson.NewObjectId().Hex()
+	trip := UberResponse{ID: bson.NewObjectId(), Status: "planning", StartingFromLocationID: start, BestRouteLocationIds: []string{stop}, Version: 1}
+	if err := memory.InsertTrip(trip); err != nil {
+		t.Fatal(err)
+	}
+	if err := memory.InsertTrip(trip); err != errDuplicate {
+		t.Errorf("inserting twice returned %v, want errDuplicate", err)
+	}
+
+	requested := trip
+	requested.Status, requested.Version = "requesting", 2
+	if err := memory.UpdateTrip(requested, 2); err != errVersionConflict {
+		t.Errorf("an update at the wrong version returned %v", err)
+	}
+	if err := memory.UpdateTrip(requested, 1); err != nil {
+		t.Fatal(err)
+	}
+	if found, err := memory.FindTrip(trip.ID.Hex()); err != nil || found.Status != "requesting" || found.Version != 2 {
+		t.Errorf("got %+v, %v", found, err)
+	}
+
+	for _, id := range []string{start, stop} {
+		if tripIDs, _ := memory.ActiveTripsUsingLocation(id); len(tripIDs) != 1 || tripIDs[0] != trip.ID.Hex() {
+			t.Errorf("location %s is used by %v", id, tripIDs)
+		}
+	}
+	completed := requested
+	completed.Status, completed.Version = "completed", 3
+	memory.UpdateTrip(completed, 2)
+	if tripIDs, _ := memory.ActiveTripsUsingLocation(start); len(tripIDs) != 0 {
+		t.Errorf("the completed trip still uses the start, %v", tripIDs)
+	}
+	if _, err := memory.FindTrip(bson.NewObjectId().Hex()); err != errNotFound {
+		t.Errorf("an unknown trip returned %v", err)
+	}
+}
+
+func TestFileStoreSurvivesRestarts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "trips.json")
+
+	//A missing file is an empty store
+	file, err := openFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept, deleted := testLocation("Office", 1), testLocation("Lab", 1)
+	file.InsertLocation(kept)
+	file.InsertLocation(deleted)
+	file.DeleteLocation(deleted.ID.Hex(), 1)
+	trip := UberResponse{ID: bson.NewObjectId(), Status: "planning", StartingFromLocationID: kept.ID.Hex(), Version: 1}
+	file.InsertTrip(trip)
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := openFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if location, err := reopened.FindLocation(kept.ID.Hex()); err != nil || location.Name != "Office" {
+		t.Errorf("got %+v, %v after reopening", location, err)
+	}
+	if _, err := reopened.FindLocation(deleted.ID.Hex()); err != errNotFound {
+		t.Errorf("the deleted location came back, %v", err)
+	}
+	if found, err := reopened.FindTrip(trip.ID.Hex()); err != nil || found.StartingFromLocationID != kept.ID.Hex() {
+		t.Errorf("got trip %+v, %v after reopening", found, err)
+	}
+	//The geohash index is rebuilt from the file
+	if nearby, _ := reopened.NearbyLocations(kept.Coordinate.Lat, kept.Coordinate.Lng, 1, 10); len(nearby) != 1 {
+		t.Errorf("found %d locations nearby after reopening, want 1", len(nearby))
+	}
+	//Saving goes through a temporary file that is renamed, so nothing is left behind
+	if entries, _ := ioutil.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("the store left %d files", len(entries))
+	}
+
+	ioutil.WriteFile(path, []byte("{not json"), 0644)
+	if _, err := openFileStore(path); err == nil {
+		t.Error("a corrupt file opened")
+	}
+}
+
+func TestNewStore(t *testing.T) {
+	tests := []struct {
+		cfg     serverConfig
+		wantErr bool
+	}{
+		{serverConfig{StoreProvider: "memory"}, false},
+		{serverConfig{StoreProvider: "file", StoreFile: filepath.Join(os.TempDir(), bson.NewObjectId().Hex()+".json")}, false},
+		{serverConfig{StoreProvider: "mongo"}, true},
+		{serverConfig{StoreProvider: "sqlite"}, true},
+	}
+	for _, test := range tests {
+		created, err := newStore(test.cfg)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: got error %v", test.cfg.StoreProvider, err)
+		}
+		if created != nil {
+			created.Close()
+		}
+	}
+}
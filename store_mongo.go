@@ -0,0 +1,383 @@
+package main
+
+import (
+	"regexp"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const mongoLocationCollection string = "addresses"
+const mongoTripCollection string = "trips"
+const mongoTombstoneCollection string = "deleted_addresses"
+const mongoHistoryCollection string = "address_history"
+const mongoGeocodeCollection string = "geocodes"
+const metersPerMile float64 = 1609.344
+
+// geoJSONPoint is the GeoJSON form of a coordinate, which the 2dsphere index requires.
+type geoJSONPoint struct {
+	Type        string     `bson:"type"`
+	Coordinates [2]float64 `bson:"coordinates"`
+}
+
+func newGeoJSONPoint(lat float64, lng float64) geoJSONPoint {
+	return geoJSONPoint{Type: "Point", Coordinates: [2]float64{lng, lat}}
+}
+
+// mongoLocation is a location as stored in Mongo, with its coordinate repeated as
+// GeoJSON for the geospatial index.
+type mongoLocation struct {
+	Location locationStruct `bson:",inline"`
+	Geo      geoJSONPoint   `bson:"geo"`
+}
+
+func newMongoLocation(location locationStruct) mongoLocation {
+	return mongoLocation{Location: location, Geo: newGeoJSONPoint(location.Coordinate.Lat, location.Coordinate.Lng)}
+}
+
+// mongoStore keeps locations and trips in MongoDB. It dials once and every operation
+// copies the root session, so requests share the driver's connection pool.
+type mongoStore struct {
+	session *mgo.Session
+	dbName  string
+}
+
+func newMongoStore(url string, dbName string) (*mongoStore, error) {
+	session, err := mgo.DialWithTimeout(url, 20*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	// Optional. Switch the session to a monotonic behavior.
+	session.SetMode(mgo.Monotonic, true)
+	mongo := &mongoStore{session: session, dbName: dbName}
+	err = mongo.ensureGeoIndex()
+	if err == nil {
+		err = mongo.ensureHistoryIndex()
+	}
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	return mongo, nil
+}
+
+// ensureGeoIndex creates the 2dsphere index and adds the GeoJSON point to locations
+// saved before the index existed.
+func (mongo *mongoStore) ensureGeoIndex() error {
+	c, s := mongo.collection(mongoLocationCollection)
+	defer s.Close()
+	err := c.EnsureIndex(mgo.Index{Key: []string{"$2dsphere:geo"}})
+	if err != nil {
+		return err
+	}
+	var location locationStruct
+	iter := c.Find(bson.M{"geo": bson.M{"$exists": false}}).Iter()
+	for iter.Next(&location) {
+		err = c.UpdateId(location.ID, bson.M{"$set": bson.M{"geo": newGeoJSONPoint(location.Coordinate.Lat, location.Coordinate.Lng)}})
+		if err != nil {
+			iter.Close()
+			return err
+		}
+	}
+	return iter.Close()
+}
+
+func (mongo *mongoStore) ensureHistoryIndex() error {
+	c, s := mongo.collection(mongoHistoryCollection)
+	defer s.Close()
+	return c.EnsureIndexKey("location_id", "_id")
+}
+
+// collection returns the named collection on a copy of the root session, which the
+// caller must close.
+func (mongo *mongoStore) collection(name string) (*mgo.Collection, *mgo.Session) {
+	session := mongo.session.Copy()
+	return session.DB(mongo.dbName).C(name), session
+}
+
+func (mongo *mongoStore) Close() error {
+	mongo.session.Close()
+	return nil
+}
+
+func (mongo *mongoStore) findByID(collectionName string, id string, result interface{}) error {
+	objectID, err := parseObjectID(id)
+	if err != nil {
+		return err
+	}
+	c, s := mongo.collection(collectionName)
+	defer s.Close()
+	return mongoError(c.FindId(objectID).One(result))
+}
+
+func (mongo *mongoStore) InsertLocation(location locationStruct) error {
+	c, s := mongo.collection(mongoLocationCollection)
+	defer s.Close()
+	return mongoError(c.Insert(newMongoLocation(location)))
+}
+
+func (mongo *mongoStore) FindLocation(id string) (locationStruct, error) {
+	var location locationStruct
+	err := mongo.findByID(mongoLocationCollection, id, &location)
+	return location, err
+}
+
+func (mongo *mongoStore) UpdateLocation(location locationStruct, version int) error {
+	c, s := mongo.collection(mongoLocationCollection)
+	defer s.Close()
+	return versionError(c, location.ID, c.Update(versionSelector(location.ID, version), newMongoLocation(location)))
+}
+
+func (mongo *mongoStore) DeleteLocation(id string, version int) error {
+	objectID, err := parseObjectID(id)
+	if err != nil {
+		return err
+	}
+	c, s := mongo.collection(mongoLocationCollection)
+	defer s.Close()
+	return versionError(c, objectID, c.Remove(versionSelector(objectID, version)))
+}
+
+func (mongo *mongoStore) SaveTombstone(tombstone locationTombstone) error {
+	c, s := mongo.collection(mongoTombstoneCollection)
+	defer s.Close()
+	_, err := c.UpsertId(tombstone.Location.ID, tombstone)
+	return mongoError(err)
+}
+
+func (mongo *mongoStore) FindTombstone(id string) (locationTombstone, error) {
+	var tombstone locationTombstone
+	err := mongo.findByID(mongoTombstoneCollection, id, &tombstone)
+	return tombstone, err
+}
+
+func (mongo *mongoStore) InsertAudit(record locationAudit) error {
+	c, s := mongo.collection(mongoHistoryCollection)
+	defer s.Close()
+	return mongoError(c.Insert(record))
+}
+
+func (mongo *mongoStore) LocationHistory(id string) ([]locationAudit, error) {
+	objectID, err := parseObjectID(id)
+	if err != nil {
+		return nil, err
+	}
+	c, s := mongo.collection(mongoHistoryCollection)
+	defer s.Close()
+	history := make([]locationAudit, 0)
+	err = c.Find(bson.M{"location_id": objectID}).Sort("_id").All(&history)
+	return history, err
+}
+
+// versionSelector matches the document while it is at version. Documents saved
+// before versioning have no version field and count as version 0.
+func versionSelector(id bson.ObjectId, version int) bson.M {
+	if version == 0 {
+		return bson.M{"_id": id, "version": bson.M{"$in": []interface{}{0, nil}}}
+	}
+	return bson.M{"_id": id, "version": version}
+}
+
+// versionError tells apart a write that matched nothing because the document is
+// gone from one that lost the race to another write.
+func versionError(c *mgo.Collection, id bson.ObjectId, err error) error {
+	if err != mgo.ErrNotFound {
+		return mongoError(err)
+	}
+	count, err := c.FindId(id).Count()
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return errVersionConflict
+	}
+	return errNotFound
+}
+
+func (mongo *mongoStore) ListLocations(query locationQuery) (locationPage, error) {
+	sortField, idField := query.SortField, "_id"
+	if sortField == "id" {
+		sortField = "_id"
+	}
+	if query.Descending {
+		sortField, idField = "-"+sortField, "-"+idField
+	}
+
+	c, s := mongo.collection(mongoLocationCollection)
+	defer s.Close()
+	locations := make([]locationStruct, 0, query.Limit+1)
+	err := c.Find(mongoLocationFilter(query)).Sort(sortField, idField).Limit(query.Limit + 1).All(&locations)
+	if err != nil {
+		return locationPage{}, err
+	}
+	return newLocationPage(query, locations), nil
+}
+
+func (mongo *mongoStore) NearbyLocations(lat float64, lng float64, radiusMiles float64, limit int) ([]nearbyLocation, error) {
+	return mongo.geoNear(bson.M{
+		"near":        newGeoJSONPoint(lat, lng),
+		"maxDistance": radiusMiles * metersPerMile,
+	}, limit)
+}
+
+// LocationsWithin filters on the plain coordinate so the box has straight latitude and
+// longitude edges, where a GeoJSON polygon would follow great circles.
+func (mongo *mongoStore) LocationsWithin(box geoBox, limit int) ([]nearbyLocation, error) {
+	lngRange := bson.M{"coordinate.lng": bson.M{"$gte": box.West, "$lte": box.East}}
+	if box.West > box.East {
+		lngRange = bson.M{"$or": []bson.M{
+			{"coordinate.lng": bson.M{"$gte": box.West}},
+			{"coordinate.lng": bson.M{"$lte": box.East}},
+		}}
+	}
+	lat, lng := box.center()
+	return mongo.geoNear(bson.M{
+		"near":  newGeoJSONPoint(lat, lng),
+		"query": bson.M{"$and": []bson.M{{"coordinate.lat": bson.M{"$gte": box.South, "$lte": box.North}}, lngRange}},
+	}, limit)
+}
+
+// geoNear runs a $geoNear aggregation with the given options, nearest first.
+func (mongo *mongoStore) geoNear(options bson.M, limit int) ([]nearbyLocation, error) {
+	options["distanceField"] = "distance"
+	options["spherical"] = true
+	options["key"] = "geo"
+
+	c, s := mongo.collection(mongoLocationCollection)
+	defer s.Close()
+	var results []struct {
+		Location locationStruct `bson:",inline"`
+		Distance float64        `bson:"distance"`
+	}
+	err := c.Pipe([]bson.M{{"$geoNear": options}, {"$limit": limit}}).All(&results)
+	if err != nil {
+		return nil, err
+	}
+	nearby := make([]nearbyLocation, len(results))
+	for i, result := range results {
+		nearby[i] = nearbyLocation{result.Location, result.Distance / metersPerMile}
+	}
+	return nearby, nil
+}
+
+// mongoLocationFilter translates the filters and cursor of a location query.
+func mongoLocationFilter(query locationQuery) bson.M {
+	conditions := make([]bson.M, 0)
+	for field, value := range map[string]string{"name": query.Name, "city": query.City, "state": query.State, "zip": query.Zip, "category": query.Category, "owner": query.Owner} {
+		if len(value) > 0 {
+			conditions = append(conditions, bson.M{field: bson.RegEx{Pattern: "^" + regexp.QuoteMeta(value) + "$", Options: "i"}})
+		}
+	}
+	if len(query.Tags) > 0 {
+		conditions = append(conditions, bson.M{"tags": bson.M{"$all": query.Tags}})
+	}
+	if len(query.Search) > 0 {
+		search := bson.RegEx{Pattern: regexp.QuoteMeta(query.Search), Options: "i"}
+		conditions = append(conditions, bson.M{"$or": []bson.M{{"name": search}, {"address": search}}})
+	}
+	if query.After != nil {
+		operator := "$gt"
+		if query.Descending {
+			operator = "$lt"
+		}
+		if query.SortField == "id" {
+			conditions = append(conditions, bson.M{"_id": bson.M{operator: query.After.ID}})
+		} else {
+			conditions = append(conditions, bson.M{"$or": []bson.M{
+				{query.SortField: bson.M{operator: query.After.Value}},
+				{query.SortField: query.After.Value, "_id": bson.M{operator: query.After.ID}},
+			}})
+		}
+	}
+	if len(conditions) == 0 {
+		return bson.M{}
+	}
+	return bson.M{"$and": conditions}
+}
+
+func (mongo *mongoStore) InsertTrip(trip UberResponse) error {
+	c, s := mongo.collection(mongoTripCollection)
+	defer s.Close()
+	return mongoError(c.Insert(trip))
+}
+
+func (mongo *mongoStore) FindTrip(id string) (UberResponse, error) {
+	var trip UberResponse
+	err := mongo.findByID(mongoTripCollection, id, &trip)
+	return trip, err
+}
+
+func (mongo *mongoStore) UpdateTrip(trip UberResponse, version int) error {
+	c, s := mongo.collection(mongoTripCollection)
+	defer s.Close()
+	return versionError(c, trip.ID, c.Update(versionSelector(trip.ID, version), trip))
+}
+
+func (mongo *mongoStore) FindGeocode(key string) (geocodeCacheEntry, error) {
+	c, s := mongo.collection(mongoGeocodeCollection)
+	defer s.Close()
+	var entry geocodeCacheEntry
+	err := c.FindId(key).One(&entry)
+	return entry, mongoError(err)
+}
+
+func (mongo *mongoStore) SaveGeocode(entry geocodeCacheEntry) error {
+	c, s := mongo.collection(mongoGeocodeCollection)
+	defer s.Close()
+	_, err := c.UpsertId(entry.Key, entry)
+	return mongoError(err)
+}
+
+func (mongo *mongoStore) DeleteGeocode(key string) error {
+	c, s := mongo.collection(mongoGeocodeCollection)
+	defer s.Close()
+	return mongoError(c.RemoveId(key))
+}
+
+func (mongo *mongoStore) PurgeGeocodes(cachedBefore time.Time) (int, error) {
+	c, s := mongo.collection(mongoGeocodeCollection)
+	defer s.Close()
+	info, err := c.RemoveAll(bson.M{"cached_at": bson.M{"$lt": cachedBefore}})
+	if err != nil {
+		return 0, err
+	}
+	return info.Removed, nil
+}
+
+func (mongo *mongoStore) CountGeocodes() (int, error) {
+	c, s := mongo.collection(mongoGeocodeCollection)
+	defer s.Close()
+	return c.Count()
+}
+
+func (mongo *mongoStore) ActiveTripsUsingLocation(id string) ([]string, error) {
+	c, s := mongo.collection(mongoTripCollection)
+	defer s.Close()
+	var trips []struct {
+		ID bson.ObjectId `bson:"_id"`
+	}
+	err := c.Find(bson.M{
+		"status": bson.M{"$ne": "completed"},
+		"$or":    []bson.M{{"starting_from_location_id": id}, {"best_route_location_ids": id}},
+	}).Select(bson.M{"_id": 1}).All(&trips)
+	if err != nil {
+		return nil, err
+	}
+	tripIDs := make([]string, len(trips))
+	for i, trip := range trips {
+		tripIDs[i] = trip.ID.Hex()
+	}
+	return tripIDs, nil
+}
+
+// mongoError translates the driver's errors into the store errors.
+func mongoError(err error) error {
+	if err == mgo.ErrNotFound {
+		return errNotFound
+	}
+	if mgo.IsDup(err) {
+		return errDuplicate
+	}
+	return err
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestNormalizeTags(t *testing.T) {
+	if got := normalizeTags([]string{" Client", "airport", "client", "", "  "}); !reflect.DeepEqual(got, []string{"airport", "client"}) {
+		t.Errorf("got %q", got)
+	}
+	if got := normalizeTags([]string{" "}); got != nil {
+		t.Errorf("blank tags gave %q", got)
+	}
+}
+
+// addTaggedLocation saves a location in one of testZips with tags and returns it.
+func addTaggedLocation(t *testing.T, name string, zip string, tags ...string) locationStruct {
+	location := testLocation(name, 1)
+	location.Coordinate.Lat, location.Coordinate.Lng = testZips[zip].Lat, testZips[zip].Lng
+	location.Zip, location.Tags = zip, normalizeTags(tags)
+	if err := store.InsertLocation(location); err != nil {
+		t.Fatal(err)
+	}
+	return location
+}
+
+func TestListLocationsByTag(t *testing.T) {
+	server, stop := newTestServer(t)
+	defer stop()
+	var created locationStruct
+	body := map[string]interface{}{"name": "Airport hotel", "zip": "94301", "tags": []string{"Hotel", " airport ", "hotel"}, "owner": " ops ", "category": " travel "}
+	if status := sendJSON(t, server, "POST", "/locations/", body, &created); status != http.StatusCreated {
+		t.Fatalf("got status %d", status)
+	}
+	if !reflect.DeepEqual(created.Tags, []string{"airport", "hotel"}) || created.Owner != "ops" || created.Category != "travel" {
+		t.Errorf("the location was saved as %+v", created)
+	}
+	addTaggedLocation(t, "Client", "95112", "client")
+	addTaggedLocation(t, "Hotel", "94105", "hotel")
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"?tag=hotel&sort=name", []string{"Airport hotel", "Hotel"}},
+		{"?tag=HOTEL&tag=airport", []string{"Airport hotel"}},
+		{"?tag=hotel&owner=OPS", []string{"Airport hotel"}},
+		{"?tag=hotel&category=work", []string{}},
+		{"?tag=museum", []string{}},
+	}
+	for _, test := range tests {
+		var page locationPage
+		if status := sendJSON(t, server, "GET", "/locations/"+test.query, nil, &page); status != http.StatusOK {
+			t.Fatalf("%s: got status %d", test.query, status)
+		}
+		names := make([]string, len(page.Locations))
+		for i, location := range page.Locations {
+			names[i] = location.Name
+		}
+		if !reflect.DeepEqual(names, test.want) {
+			t.Errorf("%s: got %q, want %q", test.query, names, test.want)
+		}
+	}
+}
+
+func TestPlanTripByLocationTag(t *testing.T) {
+	server, stop := newTestServer(t)
+	defer stop()
+	start := addTaggedLocation(t, "Office", "94105", "client", "hq")
+	warehouse := addTaggedLocation(t, "Warehouse", "94607")
+	addTaggedLocation(t, "Client", "95112", "client")
+	addTaggedLocation(t, "Lab", "94301", "Client")
+
+	//The start is left out of the tagged stops and the listed stop is not repeated
+	request := map[string]interface{}{"starting_from_location_id": start.ID.Hex(), "location_ids": []string{warehouse.ID.Hex()}, "location_tag": " CLIENT "}
+	var trip UberResponse
+	if status := sendJSON(t, server, "POST", "/trips/", request, &trip); status != http.StatusCreated {
+		t.Fatalf("got status %d", status)
+	}
+	if trip.LocationTag != "client" || len(trip.BestRouteLocationIds) != 3 || len(trip.PlannedLocations) != 4 {
+		t.Errorf("got trip %+v", trip)
+	}
+
+	tests := []struct {
+		name     string
+		request  map[string]interface{}
+		wantCode string
+	}{
+		{"no stops", map[string]interface{}{"starting_from_location_id": start.ID.Hex()}, "missing_locations"},
+		{"an unused tag", map[string]interface{}{"starting_from_location_id": start.ID.Hex(), "location_tag": "museum"}, "no_tagged_locations"},
+		{"only the start is tagged", map[string]interface{}{"starting_from_location_id": start.ID.Hex(), "location_tag": "hq"}, "no_tagged_locations"},
+	}
+	for _, test := range tests {
+		var failed apiError
+		if status := sendJSON(t, server, "POST", "/trips/", test.request, &failed); failed.Code != test.wantCode {
+			t.Errorf("%s: got %d %q, want %s", test.name, status, failed.Code, test.wantCode)
+		}
+	}
+
+	for i := 0; i <= maxTaggedStops; i++ {
+		addTaggedLocation(t, "Stop "+strconv.Itoa(i), "94301", "crowd")
+	}
+	request = map[string]interface{}{"starting_from_location_id": start.ID.Hex(), "location_tag": "crowd"}
+	var failed apiError
+	if status := sendJSON(t, server, "POST", "/trips/", request, &failed); status != http.StatusUnprocessableEntity || failed.Code != "too_many_locations" {
+		t.Errorf("%d tagged stops got %d %q", maxTaggedStops+1, status, failed.Code)
+	}
+}
+
+func TestTagsRoundTripThroughCSV(t *testing.T) {
+	locations := exportedLocations()
+	var output bytes.Buffer
+	if err := writeCSV(&output, locations); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := parseImportCSV(&output)
+	if err != nil || len(rows) != 2 {
+		t.Fatalf("got %+v, %v", rows, err)
+	}
+	office, imported := locations[0], rows[0].Location
+	if !reflect.DeepEqual(imported.Tags, normalizeTags(office.Tags)) || imported.Category != office.Category || imported.Notes != office.Notes || imported.Owner != office.Owner {
+		t.Errorf("imported %+v from %+v", imported, office)
+	}
+	if len(rows[1].Location.Tags) != 0 {
+		t.Errorf("the untagged location came back with %q", rows[1].Location.Tags)
+	}
+}
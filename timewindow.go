@@ -0,0 +1,293 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// unboundedLatest is the Latest of a window without a latest arrival.
+const unboundedLatest int = math.MaxInt32
+
+// latenessPenalty is the weight of every second a route arrives after a window,
+// large enough that local search first makes a route feasible and only then cheap.
+const latenessPenalty float64 = 1e6
+
+// tripStopRequest is a stop of a trip request with an optional arrival window and
+// the time spent at the stop before leaving for the next one.
+type tripStopRequest struct {
+	LocationID      string     `json:"location_id"`
+	EarliestArrival *time.Time `json:"earliest_arrival"`
+	LatestArrival   *time.Time `json:"latest_arrival"`
+	DwellSeconds    int        `json:"dwell_seconds"`
+}
+
+// stopWindow is a tripStopRequest in seconds after the departure from the start.
+// Arriving before Earliest means waiting until then.
+type stopWindow struct {
+	Earliest int
+	Latest   int
+	Dwell    int
+}
+
+// stopArrival is when a planned trip reaches and leaves one of its visits.
+type stopArrival struct {
+	LocationID string    `json:"location_id" bson:"location_id"`
+	Arrival    time.Time `json:"arrival" bson:"arrival"`
+	Departure  time.Time `json:"departure" bson:"departure"`
+	//Wait is how long the trip waits for the window to open, in seconds
+	Wait int `json:"wait,omitempty" bson:"wait,omitempty"`
+}
+
+// windowViolation explains a window that the least late route found still misses.
+type windowViolation struct {
+	LocationID              string    `json:"location_id"`
+	Name                    string    `json:"name"`
+	LatestArrival           time.Time `json:"latest_arrival"`
+	PlannedArrival          time.Time `json:"planned_arrival"`
+	EarliestPossibleArrival time.Time `json:"earliest_possible_arrival"`
+	Reason                  string    `json:"reason"`
+}
+
+// parseStopWindows validates the stops of a trip request and converts their windows
+// to seconds after departure.
+func parseStopWindows(stops []tripStopRequest, departure time.Time, startID string) (map[string]stopWindow, error) {
+	windows := make(map[string]stopWindow)
+	for _, stop := range stops {
+		details := map[string]string{"location_id": stop.LocationID}
+		if len(stop.LocationID) == 0 {
+			return nil, badRequest("invalid_stop", "Every stop needs a location_id", nil)
+		}
+		if stop.LocationID == startID {
+			return nil, badRequest("invalid_stop", "The starting location cannot have an arrival window", details)
+		}
+		if _, ok := windows[stop.LocationID]; ok {
+			return nil, badRequest("invalid_stop", "A location may only be listed once in stops", details)
+		}
+		if stop.DwellSeconds < 0 {
+			return nil, badRequest("invalid_stop", "dwell_seconds cannot be negative", details)
+		}
+		if stop.EarliestArrival != nil && stop.LatestArrival != nil && stop.LatestArrival.Before(*stop.EarliestArrival) {
+			return nil, badRequest("invalid_stop", "latest_arrival is before earliest_arrival", details)
+		}
+
+		window := stopWindow{Earliest: math.MinInt32, Latest: unboundedLatest, Dwell: stop.DwellSeconds}
+		if stop.EarliestArrival != nil {
+			window.Earliest = int(stop.EarliestArrival.Sub(departure) / time.Second)
+		}
+		if stop.LatestArrival != nil {
+			window.Latest = int(stop.LatestArrival.Sub(departure) / time.Second)
+		}
+		windows[stop.LocationID] = window
+	}
+	return windows, nil
+}
+
+// visits is the route followed by the end it finishes at, if any.
+func (matrix costMatrix) visits(route []int) []int {
+	if matrix.end == noRouteEnd {
+		return route
+	}
+	return append(route[:len(route):len(route)], matrix.end)
+}
+
+// schedule drives the route from the start at second 0 and returns when every visit
+// starts, after any wait for its window, along with the seconds lost to waiting and
+// the total lateness over all windows.
+func (matrix costMatrix) schedule(route []int) ([]int, []int, int) {
+	visits := matrix.visits(route)
+	starts, waits := make([]int, len(visits)), make([]int, len(visits))
+	clock, lateness, previous := 0, 0, 0
+	for i, next := range visits {
+		clock += matrix.legs[previous][next].Duration
+		window, ok := matrix.windows[next]
+		if ok && clock < window.Earliest {
+			waits[i] = window.Earliest - clock
+			clock = window.Earliest
+		}
+		if ok && clock > window.Latest {
+			lateness += clock - window.Latest
+		}
+		starts[i] = clock
+		clock += window.Dwell
+		previous = next
+	}
+	return starts, waits, lateness
+}
+
+// deadlineOrder sorts the stops by their latest arrival, the classic starting point
+// for routes with deadlines.
+func (matrix costMatrix) deadlineOrder(stops []int) []int {
+	ordered := append([]int(nil), stops...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return matrix.latest(ordered[i]) < matrix.latest(ordered[j])
+	})
+	return ordered
+}
+
+func (matrix costMatrix) latest(location int) int {
+	if window, ok := matrix.windows[location]; ok {
+		return window.Latest
+	}
+	return unboundedLatest
+}
+
+// windowLabel is a partial route of solveExactWindows: its weight, the second it
+// leaves its last stop and the label it extends.
+type windowLabel struct {
+	weight float64
+	clock  int
+	stop   int
+	parent *windowLabel
+}
+
+// solveExactWindows is solveExactTour for matrices with time windows. Every subset
+// and last stop keeps all partial routes that no other one beats on both weight and
+// clock, as a heavier but earlier route may be the only one meeting a later window.
+// It reports false when no route meets every window.
+func solveExactWindows(matrix costMatrix) ([]int, bool) {
+	n := len(matrix.stops())
+	full := 1<<uint(n) - 1
+	labels := make([][][]*windowLabel, full+1)
+	for mask := range labels {
+		labels[mask] = make([][]*windowLabel, n)
+	}
+	root := &windowLabel{stop: 0}
+	extend := func(from *windowLabel, to int) *windowLabel {
+		clock := from.clock + matrix.legs[from.stop][to].Duration
+		window, ok := matrix.windows[to]
+		if ok && clock < window.Earliest {
+			clock = window.Earliest
+		}
+		if ok && clock > window.Latest {
+			return nil
+		}
+		return &windowLabel{weight: from.weight + matrix.weight(from.stop, to), clock: clock + window.Dwell, stop: to, parent: from}
+	}
+	for j := 0; j < n; j++ {
+		if !matrix.order.canFollow(0, j+1) {
+			continue
+		}
+		if label := extend(root, j+1); label != nil {
+			labels[1<<uint(j)][j] = []*windowLabel{label}
+		}
+	}
+
+	for mask := 1; mask <= full; mask++ {
+		for last := 0; last < n; last++ {
+			for _, label := range labels[mask][last] {
+				for next := 0; next < n; next++ {
+					if mask&(1<<uint(next)) != 0 || !matrix.order.canFollow(mask, next+1) {
+						continue
+					}
+					if extended := extend(label, next+1); extended != nil {
+						nextMask := mask | 1<<uint(next)
+						labels[nextMask][next] = addParetoLabel(labels[nextMask][next], extended)
+					}
+				}
+			}
+		}
+	}
+
+	//Close the route at its end, which may have a window of its own
+	var best *windowLabel
+	bestWeight := math.Inf(1)
+	finals := []*windowLabel{root}
+	if n > 0 {
+		finals = nil
+		for last := 0; last < n; last++ {
+			finals = append(finals, labels[full][last]...)
+		}
+	}
+	for _, label := range finals {
+		weight := label.weight
+		if matrix.end != noRouteEnd {
+			closed := extend(label, matrix.end)
+			if closed == nil {
+				continue
+			}
+			weight = closed.weight
+		}
+		if weight < bestWeight {
+			best, bestWeight = label, weight
+		}
+	}
+	if best == nil {
+		return nil, false
+	}
+	route := make([]int, n)
+	for label, position := best, n-1; position >= 0; label, position = label.parent, position-1 {
+		route[position] = label.stop
+	}
+	return route, true
+}
+
+// addParetoLabel adds label to labels unless one of them is at least as light and as
+// early, dropping the ones label beats in turn.
+func addParetoLabel(labels []*windowLabel, label *windowLabel) []*windowLabel {
+	for _, other := range labels {
+		if other.weight <= label.weight && other.clock <= label.clock {
+			return labels
+		}
+	}
+	kept := labels[:0]
+	for _, other := range labels {
+		if other.weight < label.weight || other.clock < label.clock {
+			kept = append(kept, other)
+		}
+	}
+	return append(kept, label)
+}
+
+// tripSchedule lists when the trip reaches and leaves each of its visits.
+func tripSchedule(matrix costMatrix, route []int, departure time.Time) []stopArrival {
+	visits := matrix.visits(route)
+	starts, waits, _ := matrix.schedule(route)
+	schedule := make([]stopArrival, len(visits))
+	for i, visit := range visits {
+		start := departure.Add(time.Duration(starts[i]) * time.Second)
+		schedule[i] = stopArrival{
+			LocationID: matrix.locations[visit].ID.Hex(),
+			Arrival:    start.Add(-time.Duration(waits[i]) * time.Second),
+			Departure:  start.Add(time.Duration(matrix.windows[visit].Dwell) * time.Second),
+			Wait:       waits[i],
+		}
+	}
+	return schedule
+}
+
+// windowViolations lists the windows route misses. A stop that is late even when
+// driven to straight from the start is reported as unreachable. exhaustive tells
+// whether every order was tried, otherwise route is only the best one found and
+// the other windows are not proven to conflict.
+func windowViolations(matrix costMatrix, route []int, departure time.Time, exhaustive bool) []windowViolation {
+	at := func(seconds int) time.Time {
+		return departure.Add(time.Duration(seconds) * time.Second)
+	}
+	visits := matrix.visits(route)
+	starts, _, _ := matrix.schedule(route)
+	violations := make([]windowViolation, 0)
+	for i, visit := range visits {
+		window, ok := matrix.windows[visit]
+		if !ok || starts[i] <= window.Latest {
+			continue
+		}
+		violation := windowViolation{
+			LocationID:              matrix.locations[visit].ID.Hex(),
+			Name:                    matrix.locations[visit].Name,
+			LatestArrival:           at(window.Latest),
+			PlannedArrival:          at(starts[i]),
+			EarliestPossibleArrival: at(matrix.legs[0][visit].Duration),
+			Reason:                  "the window conflicts with the windows and travel times of the other stops",
+		}
+		if !exhaustive {
+			violation.Reason = "the best order found within the search budget misses the window"
+		}
+		if matrix.legs[0][visit].Duration > window.Latest {
+			violation.Reason = fmt.Sprintf("unreachable, even going straight from the start arrives %d seconds late", matrix.legs[0][visit].Duration-window.Latest)
+		}
+		violations = append(violations, violation)
+	}
+	return violations
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// randomWindows gives about half of the visits of matrix an arrival window and a
+// dwell time, tight enough that some orders miss them.
+func randomWindows(r *rand.Rand, matrix costMatrix) map[int]stopWindow {
+	windows := make(map[int]stopWindow)
+	visits := matrix.stops()
+	if matrix.end > 0 {
+		visits = append(visits, matrix.end)
+	}
+	for _, visit := range visits {
+		if r.Intn(2) == 0 {
+			continue
+		}
+		window := stopWindow{Earliest: math.MinInt32, Latest: unboundedLatest, Dwell: r.Intn(300)}
+		if r.Intn(2) == 0 {
+			window.Earliest = r.Intn(4000)
+		}
+		if r.Intn(3) > 0 {
+			window.Latest = r.Intn(6000) + 1000
+			if window.Latest < window.Earliest {
+				window.Latest = window.Earliest
+			}
+		}
+		windows[visit] = window
+	}
+	return windows
+}
+
+func meetsWindows(matrix costMatrix) func([]int) bool {
+	return func(route []int) bool {
+		_, _, lateness := matrix.schedule(route)
+		return lateness == 0
+	}
+}
+
+func TestSolveExactWindowsMatchesBruteForce(t *testing.T) {
+	tests := []struct {
+		name  string
+		stops int
+		end   int
+	}{
+		{"no stops", 0, 0},
+		{"round trip", 6, 0},
+		{"open route", 6, noRouteEnd},
+		{"fixed destination", 5, 1},
+	}
+	feasible, infeasible := 0, 0
+	for _, test := range tests {
+		r := rand.New(rand.NewSource(int64(test.stops)*17 + int64(test.end)))
+		for trial := 0; trial < 40; trial++ {
+			matrix := randomMatrix(r, test.stops, test.end)
+			matrix.windows = randomWindows(r, matrix)
+			want := bruteForceWeight(matrix, meetsWindows(matrix))
+			route, ok := solveExactWindows(matrix)
+			if ok != !math.IsInf(want, 1) {
+				t.Fatalf("%s: solveExactWindows reported %v, the best order meeting the windows weighs %v", test.name, ok, want)
+			}
+			if !ok {
+				infeasible++
+				continue
+			}
+			feasible++
+			if !sameStops(matrix, route) || !meetsWindows(matrix)(route) {
+				t.Fatalf("%s: solveExactWindows returned %v, which misses a window", test.name, route)
+			}
+			if got := tourWeight(matrix, route); got != want {
+				t.Errorf("%s: route %v weighs %v, the best order meeting the windows weighs %v", test.name, route, got, want)
+			}
+		}
+	}
+	if feasible == 0 || infeasible == 0 {
+		t.Errorf("the random windows gave %d feasible and %d infeasible trips, want both", feasible, infeasible)
+	}
+}
+
+func TestAddParetoLabel(t *testing.T) {
+	existing := func() []*windowLabel {
+		return []*windowLabel{{weight: 10, clock: 500}, {weight: 20, clock: 300}}
+	}
+	tests := []struct {
+		name  string
+		label windowLabel
+		//want lists the weights of the labels kept, in order
+		want []float64
+	}{
+		{"dominated", windowLabel{weight: 15, clock: 600}, []float64{10, 20}},
+		{"equal to one", windowLabel{weight: 10, clock: 500}, []float64{10, 20}},
+		{"lighter but later", windowLabel{weight: 5, clock: 700}, []float64{10, 20, 5}},
+		{"earlier but heavier", windowLabel{weight: 30, clock: 100}, []float64{10, 20, 30}},
+		{"beats one", windowLabel{weight: 10, clock: 400}, []float64{20, 10}},
+		{"beats both", windowLabel{weight: 1, clock: 1}, []float64{1}},
+	}
+	for _, test := range tests {
+		label := test.label
+		labels := addParetoLabel(existing(), &label)
+		if len(labels) != len(test.want) {
+			t.Errorf("%s: kept %d labels, want %d", test.name, len(labels), len(test.want))
+			continue
+		}
+		for i, kept := range labels {
+			if kept.weight != test.want[i] {
+				t.Errorf("%s: label %d weighs %v, want %v", test.name, i, kept.weight, test.want[i])
+			}
+		}
+	}
+}
+
+func TestParseStopWindows(t *testing.T) {
+	departure := time.Date(2016, 5, 2, 9, 0, 0, 0, time.UTC)
+	at := func(minutes int) *time.Time {
+		when := departure.Add(time.Duration(minutes) * time.Minute)
+		return &when
+	}
+	tests := []struct {
+		name    string
+		stops   []tripStopRequest
+		want    map[string]stopWindow
+		wantErr bool
+	}{
+		{"no window", []tripStopRequest{{LocationID: "a", DwellSeconds: 60}},
+			map[string]stopWindow{"a": {Earliest: math.MinInt32, Latest: unboundedLatest, Dwell: 60}}, false},
+		{"window", []tripStopRequest{{LocationID: "a", EarliestArrival: at(30), LatestArrival: at(45)}},
+			map[string]stopWindow{"a": {Earliest: 1800, Latest: 2700}}, false},
+		{"latest only", []tripStopRequest{{LocationID: "a", LatestArrival: at(-5)}},
+			map[string]stopWindow{"a": {Earliest: math.MinInt32, Latest: -300}}, false},
+		{"missing location", []tripStopRequest{{EarliestArrival: at(5)}}, nil, true},
+		{"the start", []tripStopRequest{{LocationID: "start", LatestArrival: at(5)}}, nil, true},
+		{"listed twice", []tripStopRequest{{LocationID: "a"}, {LocationID: "a"}}, nil, true},
+		{"negative dwell", []tripStopRequest{{LocationID: "a", DwellSeconds: -1}}, nil, true},
+		{"closes before it opens", []tripStopRequest{{LocationID: "a", EarliestArrival: at(30), LatestArrival: at(20)}}, nil, true},
+	}
+	for _, test := range tests {
+		windows, err := parseStopWindows(test.stops, departure, "start")
+		if test.wantErr {
+			if apiErr, ok := err.(*apiError); !ok || apiErr.Status != http.StatusBadRequest {
+				t.Errorf("%s: got error %v, want a bad request", test.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if len(windows) != len(test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, windows, test.want)
+		}
+		for id, window := range test.want {
+			if windows[id] != window {
+				t.Errorf("%s: got window %+v for %s, want %+v", test.name, windows[id], id, window)
+			}
+		}
+	}
+}
+
+func TestPlanTripWithTimeWindows(t *testing.T) {
+	server, stop := newTestServer(t)
+	defer stop()
+	start := addTestLocation(t, server, "Office", "94105")
+	client := addTestLocation(t, server, "Client", "95112")
+	lab := addTestLocation(t, server, "Lab", "94301")
+	departure := time.Date(2016, 5, 2, 9, 0, 0, 0, time.UTC)
+	at := func(minutes int) *time.Time {
+		when := departure.Add(time.Duration(minutes) * time.Minute)
+		return &when
+	}
+
+	//The client is 83 minutes away, or 88 by way of the lab which is 54 minutes away
+	tests := []struct {
+		name       string
+		stops      []tripStopRequest
+		wantStatus int
+		wantCode   string
+		//wantFirst is the stop the windows force first, if any
+		wantFirst string
+	}{
+		{"client first", []tripStopRequest{{LocationID: client, LatestArrival: at(85), DwellSeconds: 1800}, {LocationID: lab}}, http.StatusCreated, "", client},
+		{"lab first", []tripStopRequest{{LocationID: client}, {LocationID: lab, LatestArrival: at(60)}}, http.StatusCreated, "", lab},
+		{"unreachable", []tripStopRequest{{LocationID: client, LatestArrival: at(30)}, {LocationID: lab}}, http.StatusUnprocessableEntity, "infeasible_time_windows", ""},
+		{"conflicting", []tripStopRequest{{LocationID: client, LatestArrival: at(85)}, {LocationID: lab, LatestArrival: at(60)}}, http.StatusUnprocessableEntity, "infeasible_time_windows", ""},
+		{"invalid", []tripStopRequest{{LocationID: client, DwellSeconds: -5}}, http.StatusBadRequest, "invalid_stop", ""},
+	}
+	for _, test := range tests {
+		request := UberPostRequest{StartingFromLocationID: start, Stops: test.stops, DepartureTime: &departure}
+		var trip struct {
+			UberResponse
+			Code    string `json:"code"`
+			Details struct {
+				Violations []windowViolation `json:"violations"`
+			} `json:"details"`
+		}
+		status := sendJSON(t, server, "POST", "/trips/", request, &trip)
+		if status != test.wantStatus || trip.Code != test.wantCode {
+			t.Fatalf("%s: got status %d and code %q, want %d and %q", test.name, status, trip.Code, test.wantStatus, test.wantCode)
+		}
+		if test.wantCode == "infeasible_time_windows" && len(trip.Details.Violations) == 0 {
+			t.Errorf("%s: no violation was reported", test.name)
+		}
+		if status != http.StatusCreated {
+			continue
+		}
+		if trip.BestRouteLocationIds[0] != test.wantFirst {
+			t.Errorf("%s: got route %v, want %s first", test.name, trip.BestRouteLocationIds, test.wantFirst)
+		}
+		//The schedule lists the stops and the return to the start
+		if len(trip.Schedule) != 3 || trip.Schedule[2].LocationID != start {
+			t.Fatalf("%s: got schedule %+v", test.name, trip.Schedule)
+		}
+		for i, arrival := range trip.Schedule[:2] {
+			for _, stop := range test.stops {
+				if stop.LocationID == arrival.LocationID && stop.LatestArrival != nil && arrival.Arrival.After(*stop.LatestArrival) {
+					t.Errorf("%s: visit %d arrives at %v, after %v", test.name, i, arrival.Arrival, *stop.LatestArrival)
+				}
+			}
+		}
+	}
+}